@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// renderStats accumulates renderer statistics of a single request, which may
+// run several conversions, i.e. at /merge
+type renderStats struct {
+	mu       sync.Mutex
+	renders  int
+	queued   time.Duration // time spent waiting for free conversion slots
+	rendered time.Duration // time spent running renderer
+	maxRSS   int64         // peak resident set size of renderer processes
+}
+
+type renderStatsKey struct{}
+
+// addRenderStats records conversion finished with process state ps to stats
+// attached to ctx by accessLogger, if any
+func addRenderStats(ctx context.Context, queued, rendered time.Duration, ps *os.ProcessState) {
+	s, ok := ctx.Value(renderStatsKey{}).(*renderStats)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renders++
+	s.queued += queued
+	s.rendered += rendered
+	if rss := maxRSS(ps); rss > s.maxRSS {
+		s.maxRSS = rss
+	}
+}
+
+// accessLogger writes a line per served request in either Common Log Format
+// followed by extra fields, or as a JSON object
+type accessLogger struct {
+	json bool
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newAccessLogger returns logger writing to stdout if dest is "-", or to the
+// named file, which is rotated once it grows over maxSize, unless it's 0,
+// keeping given number of rotated files
+func newAccessLogger(dest, format string, maxSize int64, backups int) (*accessLogger, error) {
+	l := &accessLogger{}
+	switch format {
+	case "common":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("unsupported access log format %q", format)
+	}
+	if dest == "-" {
+		l.w = os.Stdout
+		return l, nil
+	}
+	f, err := openRotatingFile(dest, maxSize, backups)
+	if err != nil {
+		return nil, err
+	}
+	l.w = f
+	return l, nil
+}
+
+// accessEntry is a JSON access log line
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RemoteIP  string    `json:"remote_ip"`
+	Client    string    `json:"client"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	Renders   int       `json:"renders"`
+	Queued    float64   `json:"queued"`
+	Rendered  float64   `json:"render_time"`
+	MaxRSS    int64     `json:"max_rss,omitempty"`
+}
+
+// wrap wraps next handler, logging every request it serves
+func (l *accessLogger) wrap(h *handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		stats := &renderStats{}
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), renderStatsKey{}, stats)))
+		stats.mu.Lock()
+		e := accessEntry{
+			Time:      begin,
+			RemoteIP:  h.clientHost(r),
+			Client:    h.clientKey(r),
+			RequestID: w.Header().Get("X-Request-Id"),
+			Method:    r.Method,
+			Path:      r.RequestURI,
+			Proto:     r.Proto,
+			Status:    rw.status,
+			Bytes:     rw.written,
+			Duration:  time.Since(begin).Seconds(),
+			Renders:   stats.renders,
+			Queued:    stats.queued.Seconds(),
+			Rendered:  stats.rendered.Seconds(),
+			MaxRSS:    stats.maxRSS,
+		}
+		stats.mu.Unlock()
+		l.log(&e)
+	})
+}
+
+func (l *accessLogger) log(e *accessEntry) {
+	var b []byte
+	if l.json {
+		b, _ = json.Marshal(e)
+		b = append(b, '\n')
+	} else {
+		// Common Log Format: host ident authuser [date] "request" status bytes
+		b = fmt.Appendf(nil, "%s - %s [%s] %s %d %d %.3f %s renders=%d queued=%.3f render_time=%.3f max_rss=%d\n",
+			e.RemoteIP, e.Client, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.Method+" "+e.Path+" "+e.Proto), e.Status, e.Bytes,
+			e.Duration, dash(e.RequestID), e.Renders, e.Queued, e.Rendered, e.MaxRSS)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b)
+}
+
+// dash returns s, or "-" if s is empty, as Common Log Format denotes missing
+// values
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// recordingWriter records status code and number of bytes of the reply
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.status, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (w *recordingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// rotatingFile is a file that is renamed to name.1 once it grows over max
+// size, shifting previously rotated files up to name.<backups>
+type rotatingFile struct {
+	name    string
+	max     int64
+	backups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(name string, max int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{name: name, max: max, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write appends b to the file, rotating it first if needed. It's not safe
+// for concurrent use.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	if rf.max > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.max {
+		if err := rf.rotate(); err != nil {
+			slog.Error("rotating access log failed", "error", err)
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and opens a new one; if renaming fails, writes
+// continue to the same file. Old file is only closed once the new one is
+// open: if opening fails, writes continue to the old file under its new name
+// and rotation is tried again once it grows by max size more.
+func (rf *rotatingFile) rotate() error {
+	old := rf.f
+	for i := rf.backups - 1; i > 0; i-- {
+		os.Rename(rf.name+"."+strconv.Itoa(i), rf.name+"."+strconv.Itoa(i+1))
+	}
+	if rf.backups > 0 {
+		os.Rename(rf.name, rf.name+".1")
+	} else {
+		os.Remove(rf.name)
+	}
+	if err := rf.open(); err != nil {
+		rf.size = 0
+		return err
+	}
+	old.Close()
+	return nil
+}
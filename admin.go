@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// adminHandler returns handler of operational endpoints served at
+// -admin-addr. They don't require authentication, so this address is
+// expected to be reachable by operators only.
+func (h *handler) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", serveVars)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	// /debug/pprof/cmdline is left out for the same reason as in serveVars
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/metrics", h.serveMetrics)
+	mux.HandleFunc("/healthz", h.serveHealth)
+	mux.HandleFunc("/readyz", h.serveReady)
+	mux.HandleFunc("/-/reload", h.serveReload)
+	mux.HandleFunc("/-/config", h.serveConfig)
+	mux.HandleFunc("/-/queue", h.serveQueue)
+	if h.fontAPI {
+		mux.HandleFunc("/fonts/", h.serveFont)
+	}
+	return mux
+}
+
+// serveVars is like expvar.Handler, but it leaves out command line, as it
+// may have secrets
+func serveVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	var b strings.Builder
+	b.WriteString("{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			b.WriteString(",\n")
+		}
+		first = false
+		fmt.Fprintf(&b, "%q: %s", kv.Key, kv.Value)
+	})
+	b.WriteString("\n}\n")
+	w.Write([]byte(b.String()))
+}
+
+// publishRuntimeVars publishes expvar variables useful to diagnose leaks:
+// number of goroutines, busy conversion slots, and open files, along with
+// how many of them are in the system temporary directory or in dirs.
+func (h *handler) publishRuntimeVars(dirs ...string) {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("busy", expvar.Func(func() any { return h.gate.state().Busy }))
+	tmp := []string{os.TempDir()}
+	for _, dir := range dirs {
+		if dir != "" {
+			tmp = append(tmp, dir)
+		}
+	}
+	expvar.Publish("files", expvar.Func(func() any { return openFiles(tmp) }))
+}
+
+// openFiles returns number of file descriptors open by the process, and
+// number of those referring to files in any of tmp directories
+func openFiles(tmp []string) map[string]int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil
+	}
+	out := map[string]int{"open": len(fds), "temp": 0}
+	for _, fd := range fds {
+		name, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err != nil {
+			continue
+		}
+		for _, dir := range tmp {
+			if strings.HasPrefix(name, filepath.Clean(dir)+string(filepath.Separator)) {
+				out["temp"]++
+				break
+			}
+		}
+	}
+	return out
+}
+
+// secretFlags are flags whose values are redacted at /-/config
+var secretFlags = map[string]bool{
+	"token": true, "jwt-secret": true, "signing-secret": true, "callback-secret": true,
+}
+
+// serveConfig handles /-/config requests, replying with JSON object of flag
+// values service currently runs with
+func (h *handler) serveConfig(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	out := make(map[string]string, len(h.flags))
+	for k, v := range h.flags {
+		if secretFlags[k] && v != "" {
+			v = "REDACTED"
+		}
+		out[k] = v
+	}
+	h.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(out)
+}
+
+// serveQueue handles /-/queue requests, replying with JSON describing
+// conversion slots and requests waiting for them
+func (h *handler) serveQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(h.gate.state())
+}
+
+// serveMetrics handles /metrics requests, replying with metrics in
+// Prometheus text format
+func (h *handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	st := h.gate.state()
+	queued := make(map[string]int)
+	for _, p := range []priority{priorityLow, priorityNormal, priorityHigh} {
+		queued[p.String()] = 0
+	}
+	for _, q := range st.Queued {
+		queued[q.Priority]++
+	}
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	gauge("pdfsvc_slots", "Number of concurrent conversion slots.")
+	fmt.Fprintf(&b, "pdfsvc_slots %d\n", st.Slots)
+	gauge("pdfsvc_slots_busy", "Number of conversion slots in use.")
+	fmt.Fprintf(&b, "pdfsvc_slots_busy %d\n", st.Busy)
+	gauge("pdfsvc_queued_requests", "Number of requests waiting for a conversion slot.")
+	for _, k := range sortedKeys(queued) {
+		fmt.Fprintf(&b, "pdfsvc_queued_requests{priority=%q} %d\n", k, queued[k])
+	}
+	fmt.Fprintf(&b, "# HELP pdfsvc_shed_requests_total Number of requests rejected because conversion queue was full or too slow.\n# TYPE pdfsvc_shed_requests_total counter\n")
+	shed := h.gate.shedCounts()
+	for _, k := range []string{"queue_full", "queue_timeout"} {
+		fmt.Fprintf(&b, "pdfsvc_shed_requests_total{reason=%q} %d\n", k, shed[k])
+	}
+	fmt.Fprintf(&b, "# HELP pdfsvc_renderer_retries_total Number of conversions retried after renderer crashed.\n# TYPE pdfsvc_renderer_retries_total counter\n")
+	fmt.Fprintf(&b, "pdfsvc_renderer_retries_total %d\n", h.retries.Load())
+	if h.breaker != nil {
+		open := 0
+		if h.breaker.isOpen() {
+			open = 1
+		}
+		gauge("pdfsvc_breaker_open", "Whether renderer circuit breaker is open.")
+		fmt.Fprintf(&b, "pdfsvc_breaker_open %d\n", open)
+	}
+	if h.inflight != nil {
+		usage := h.inflight.usage()
+		gauge("pdfsvc_client_inflight_requests", "Number of in-flight requests per client.")
+		for _, k := range sortedKeys(usage) {
+			fmt.Fprintf(&b, "pdfsvc_client_inflight_requests{client=\"%s\"} %d\n", labelEscaper.Replace(k), usage[k])
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// labelEscaper escapes Prometheus label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
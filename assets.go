@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// indexFile is a name of the main document in multi-file uploads
+const indexFile = "index.html"
+
+// coverFile is a name of the optional cover page document in multi-file
+// uploads
+const coverFile = "cover.html"
+
+// userStyleFile is a name of the optional user stylesheet in multi-file
+// uploads, applied the same way as X-Pdf-User-Stylesheet header
+const userStyleFile = "user.css"
+
+// maxBundleSize limits total size of files unpacked from a ZIP bundle
+const maxBundleSize = 256 << 20
+
+// serveMultipart handles multipart/form-data requests holding html document
+// along with its assets (images, stylesheets, fonts). Each part is saved to a
+// per-request temporary directory using part's form name as a relative path,
+// then part named index.html is converted, so that it can refer to other
+// parts with relative urls.
+func (h *handler) serveMultipart(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	dir, err := os.MkdirTemp("", "pdfsvc-assets-")
+	if err != nil {
+		ctxLogger(r.Context()).Error("creating assets directory failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+		if err := saveAsset(dir, part.FormName(), part); err != nil {
+			if h.noisy.Load() {
+				ctxLogger(r.Context()).Info("saving asset failed", "name", part.FormName(), "error", err)
+			}
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+	}
+	h.serveIndex(w, r, dir)
+}
+
+// serveIndex converts index.html document from dir with assets, prepending
+// cover.html as a cover page and applying user.css if dir has them
+func (h *handler) serveIndex(w http.ResponseWriter, r *http.Request, dir string) {
+	src := source{file: filepath.Join(dir, indexFile)}
+	if !isRegular(src.file) {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if cover := filepath.Join(dir, coverFile); isRegular(cover) {
+		src.cover = cover
+	}
+	if name := filepath.Join(dir, userStyleFile); isRegular(name) {
+		b, err := os.ReadFile(name)
+		if err == nil {
+			err = checkUserStyle(string(b))
+		}
+		if err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+		src.userCSS = string(b)
+	}
+	h.serveConverted(w, r, src)
+}
+
+func isRegular(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// saveAsset saves contents of r to a file with relative name inside dir
+func saveAsset(dir, name string, r io.Reader) error {
+	if !filepath.IsLocal(name) {
+		return errors.New("invalid asset name")
+	}
+	name = filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(name); err == nil {
+		return errors.New("duplicate asset name")
+	}
+	return writeFile(name, r)
+}
+
+// serveBundle handles application/zip requests holding html document named
+// index.html along with its assets. Archive is unpacked to a per-request
+// temporary directory, then index.html is converted, so that it can refer to
+// other files with relative urls.
+func (h *handler) serveBundle(w http.ResponseWriter, r *http.Request) {
+	l := ctxLogger(r.Context())
+	dir, err := os.MkdirTemp("", "pdfsvc-assets-")
+	if err != nil {
+		l.Error("creating assets directory failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.CreateTemp("", "pdfsvc-bundle-")
+	if err != nil {
+		l.Error("creating bundle file failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r.Body)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if err := unpackBundle(dir, f, size); err != nil {
+		if h.noisy.Load() {
+			l.Info("unpacking bundle failed", "error", err)
+		}
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	h.serveIndex(w, r, dir)
+}
+
+// unpackBundle extracts regular files of ZIP archive to dir
+func unpackBundle(dir string, ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	var left int64 = maxBundleSize
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			return errors.New("non-regular file in bundle: " + zf.Name)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		lr := &io.LimitedReader{R: rc, N: left + 1}
+		err = saveAsset(dir, zf.Name, lr)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if left = lr.N - 1; left < 0 {
+			return errors.New("bundle is too large")
+		}
+	}
+	return nil
+}
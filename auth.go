@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// authorized reports whether request carries one of the accepted Bearer
+// tokens, a valid JWT, or a valid X-Signature. If no tokens are configured,
+// all requests are authorized.
+func (h *handler) authorized(r *http.Request) bool {
+	p := h.policy.Load()
+	if !h.authRequired(p) {
+		return true
+	}
+	if h.signer != nil && r.Header.Get("X-Signature") != "" {
+		err := h.signer.verify(r, time.Now())
+		if err != nil && h.noisy.Load() {
+			ctxLogger(r.Context()).Info("request signature rejected", "error", err)
+		}
+		return err == nil
+	}
+	val := bearerToken(r)
+	if val == "" {
+		return false
+	}
+	err := h.checkToken(p, val)
+	if err != nil && err != errUnknownToken && h.noisy.Load() {
+		ctxLogger(r.Context()).Info("JWT rejected", "error", err)
+	}
+	return err == nil
+}
+
+// authRequired reports whether any tokens, JWT keys or signature secret are
+// configured
+func (h *handler) authRequired(p *policy) bool {
+	return p.token != "" || len(p.hashes) != 0 || h.tokens != nil || h.jwt != nil || h.signer != nil
+}
+
+var errUnknownToken = errors.New("unknown token")
+
+// checkToken returns nil if val is one of the accepted Bearer tokens or a
+// valid JWT. Unlike authorized, it has no side effects, so it may be called
+// more than once per request.
+func (h *handler) checkToken(p *policy, val string) error {
+	if p.token != "" && val == p.token {
+		return nil
+	}
+	if h.tokens != nil {
+		if _, ok := h.tokens.lookup(val); ok {
+			return nil
+		}
+	}
+	for _, th := range p.hashes {
+		if th.match(val) {
+			return nil
+		}
+	}
+	if h.jwt != nil {
+		_, err := h.jwt.verify(val, time.Now())
+		return err
+	}
+	return errUnknownToken
+}
+
+// tokenName returns name of request token from the token file, or subject
+// of a valid JWT, or an empty string if token has no name
+func (h *handler) tokenName(r *http.Request) string {
+	token := bearerToken(r)
+	if token == "" {
+		return ""
+	}
+	if h.tokens != nil {
+		if name, ok := h.tokens.lookup(token); ok {
+			return name
+		}
+	}
+	if h.jwt != nil {
+		sub, _ := h.jwt.verify(token, time.Now())
+		return sub
+	}
+	return ""
+}
+
+// bearerToken returns token from request Authorization header, or an empty
+// string if there is none.
+func bearerToken(r *http.Request) string {
+	hdr := r.Header.Get("Authorization")
+	if val := strings.TrimPrefix(hdr, "Bearer "); val != hdr {
+		return val
+	}
+	return ""
+}
+
+// tokenHash is a salted SHA-256 hash of an accepted token. Its text form is
+//
+//	sha256:<hex-encoded salt>:<hex-encoded sha256(salt + token)>
+type tokenHash struct {
+	salt []byte
+	sum  [sha256.Size]byte
+}
+
+func (th tokenHash) match(token string) bool {
+	return subtle.ConstantTimeCompare(saltedSum(th.salt, token), th.sum[:]) == 1
+}
+
+func saltedSum(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	io.WriteString(h, token)
+	return h.Sum(nil)
+}
+
+func (th tokenHash) String() string {
+	return "sha256:" + hex.EncodeToString(th.salt) + ":" + hex.EncodeToString(th.sum[:])
+}
+
+func parseTokenHash(s string) (tokenHash, error) {
+	var th tokenHash
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 || fields[0] != "sha256" {
+		return th, errors.New("unsupported hash format")
+	}
+	salt, err := hex.DecodeString(fields[1])
+	if err != nil || len(salt) == 0 {
+		return th, errors.New("invalid salt")
+	}
+	sum, err := hex.DecodeString(fields[2])
+	if err != nil || len(sum) != sha256.Size {
+		return th, errors.New("invalid hash")
+	}
+	th.salt = salt
+	copy(th.sum[:], sum)
+	return th, nil
+}
+
+// newTokenHash returns text form of a freshly salted hash of token, suitable
+// for use as a line in token hash file.
+func newTokenHash(token string) (string, error) {
+	th := tokenHash{salt: make([]byte, 16)}
+	if _, err := rand.Read(th.salt); err != nil {
+		return "", err
+	}
+	copy(th.sum[:], saltedSum(th.salt, token))
+	return th.String(), nil
+}
+
+// readTokenHashes reads file with one token hash per line. Empty lines and
+// lines starting with # are ignored.
+func readTokenHashes(name string) ([]tokenHash, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []tokenHash
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		th, err := parseTokenHash(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+		out = append(out, th)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s: no token hashes found", name)
+	}
+	return out, nil
+}
+
+// tokenSet holds tokens read from a file, each line of which is either a
+// token, or a token followed by = and its name, optionally followed by
+// space-separated slots=N attribute limiting its concurrent conversions.
+// Tokens are any non-space characters, so that base64 tokens with = padding
+// are allowed; names start with a letter, digit or underscore. Empty lines
+// and lines starting with # are ignored.
+type tokenSet struct {
+	file string
+
+	mu     sync.RWMutex
+	tokens []namedToken
+}
+
+// tokenLine matches lines of token file with named tokens: as tokens may end
+// with = padding, name follows the last = that is followed by a name
+var tokenLine = regexp.MustCompile(`^(\S+)\s*=\s*([A-Za-z0-9_][^\s=]*)(\s.*)?$`)
+
+type namedToken struct {
+	token, name string
+	slots       int // max concurrent conversions, unlimited if 0
+}
+
+func loadTokenFile(name string) (*tokenSet, error) {
+	ts := &tokenSet{file: name}
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// reload reads tokens from file. On error, previously loaded tokens are
+// kept.
+func (ts *tokenSet) reload() error {
+	f, err := os.Open(ts.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var out []namedToken
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "=") {
+			return fmt.Errorf("%s:%d: empty token", ts.file, n)
+		}
+		nt := namedToken{token: line}
+		var attrs []string
+		if m := tokenLine.FindStringSubmatch(line); m != nil {
+			nt.token, nt.name, attrs = m[1], m[2], strings.Fields(m[3])
+		} else if strings.IndexFunc(line, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("%s:%d: invalid token line, want token=name [slots=N]", ts.file, n)
+		}
+		for _, f := range attrs {
+			k, v, _ := strings.Cut(f, "=")
+			if k != "slots" {
+				return fmt.Errorf("%s:%d: unknown attribute %q", ts.file, n, k)
+			}
+			if nt.slots, err = strconv.Atoi(v); err != nil || nt.slots < 1 {
+				return fmt.Errorf("%s:%d: slots must be a positive number", ts.file, n)
+			}
+		}
+		if nt.slots != 0 && nt.name == "" {
+			// slots are shared by name, as the same name can be given
+			// to several tokens
+			return fmt.Errorf("%s:%d: token with slots must have a name", ts.file, n)
+		}
+		out = append(out, nt)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return fmt.Errorf("%s: no tokens found", ts.file)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens = out
+	return nil
+}
+
+// slots returns name of token and max number of its concurrent conversions,
+// which is 0 if token is not in the set or if it's not limited
+func (ts *tokenSet) slots(token string) (string, int) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, nt := range ts.tokens {
+		if subtle.ConstantTimeCompare([]byte(nt.token), []byte(token)) == 1 {
+			return nt.name, nt.slots
+		}
+	}
+	return "", 0
+}
+
+// lookup reports whether token is in the set, returning its name, which may
+// be empty.
+func (ts *tokenSet) lookup(token string) (string, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, nt := range ts.tokens {
+		if subtle.ConstantTimeCompare([]byte(nt.token), []byte(token)) == 1 {
+			return nt.name, true
+		}
+	}
+	return "", false
+}
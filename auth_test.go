@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokenFile(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		want    namedToken
+		wantErr bool
+	}{
+		{line: "3f9c1b2a7d6e", want: namedToken{token: "3f9c1b2a7d6e"}},
+		{line: "3f9c1b2a7d6e=billing", want: namedToken{token: "3f9c1b2a7d6e", name: "billing"}},
+		{line: "3f9c1b2a7d6e = billing slots=2", want: namedToken{token: "3f9c1b2a7d6e", name: "billing", slots: 2}},
+		{line: "c2VjcmV0==", want: namedToken{token: "c2VjcmV0=="}},
+		{line: "c2VjcmV0===billing", want: namedToken{token: "c2VjcmV0==", name: "billing"}},
+		{line: "c2VjcmV0== = billing slots=1", want: namedToken{token: "c2VjcmV0==", name: "billing", slots: 1}},
+		{line: "a+b/c=d=_svc", want: namedToken{token: "a+b/c=d", name: "_svc"}},
+		{line: "=billing", wantErr: true},
+		{line: "3f9c1b2a7d6e billing", wantErr: true},
+		{line: "3f9c1b2a7d6e slots=2", wantErr: true},
+		{line: "3f9c1b2a7d6e=billing slots=0", wantErr: true},
+		{line: "3f9c1b2a7d6e=billing color=red", wantErr: true},
+	} {
+		name := filepath.Join(t.TempDir(), "tokens")
+		if err := os.WriteFile(name, []byte("# tokens\n\n"+tc.line+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		ts, err := loadTokenFile(name)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("%q: got tokens %+v, want error", tc.line, ts.tokens)
+		case !tc.wantErr && err != nil:
+			t.Errorf("%q: %v", tc.line, err)
+		case !tc.wantErr && (len(ts.tokens) != 1 || ts.tokens[0] != tc.want):
+			t.Errorf("%q: got tokens %+v, want %+v", tc.line, ts.tokens, tc.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryPressure is a fraction of available memory below which tuner reduces
+// concurrency
+const memoryPressure = 0.1
+
+// tuner adjusts gate size between min and max: concurrency is halved when
+// available memory runs low, reduced by one when average conversion takes
+// longer than latency, and increased by one when all slots are busy.
+type tuner struct {
+	g        *gate
+	min, max int
+	latency  time.Duration
+
+	mu    sync.Mutex
+	total time.Duration // sum of conversion times since last adjustment
+	count int
+}
+
+// observe records duration of a finished conversion. It's safe to call on a
+// nil tuner.
+func (t *tuner) observe(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total += d
+	t.count++
+}
+
+// run adjusts gate size every interval, it never returns
+func (t *tuner) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.adjust()
+	}
+}
+
+func (t *tuner) adjust() {
+	t.mu.Lock()
+	var avg time.Duration
+	if t.count != 0 {
+		avg = t.total / time.Duration(t.count)
+	}
+	t.total, t.count = 0, 0
+	t.mu.Unlock()
+
+	n := t.g.limit()
+	size := n
+	avail, ok := availableMemory()
+	switch {
+	case ok && avail < memoryPressure:
+		size = n / 2
+	case t.latency > 0 && avg > t.latency:
+		size = n - 1
+	case t.g.saturated(0):
+		size = n + 1
+	}
+	size = max(t.min, min(t.max, size))
+	if size == n {
+		return
+	}
+	t.g.resize(size)
+	slog.Info("concurrency adjusted", "from", n, "to", size,
+		"avg_duration", avg.Round(time.Millisecond), "available_memory", avail)
+}
+
+// availableMemory returns fraction of memory available, as limited by cgroup
+// v2 memory controller if there's a limit, or reported by /proc/meminfo
+func availableMemory() (float64, bool) {
+	if b, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		limit, err := strconv.ParseUint(string(bytes.TrimSpace(b)), 10, 64)
+		if err == nil && limit > 0 {
+			if used, ok := cgroupMemoryUsed(); ok {
+				if used > limit {
+					return 0, true
+				}
+				return float64(limit-used) / float64(limit), true
+			}
+		}
+	}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	var total, avail uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "MemAvailable:":
+			avail, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(avail) / float64(total), true
+}
+
+// cgroupMemoryUsed returns memory used by cgroup, not counting inactive page
+// cache which can be reclaimed
+func cgroupMemoryUsed() (uint64, bool) {
+	b, err := os.ReadFile("/sys/fs/cgroup/memory.current")
+	if err != nil {
+		return 0, false
+	}
+	used, err := strconv.ParseUint(string(bytes.TrimSpace(b)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if b, err = os.ReadFile("/sys/fs/cgroup/memory.stat"); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if v, ok := strings.CutPrefix(line, "inactive_file "); ok {
+				if n, err := strconv.ParseUint(v, 10, 64); err == nil && n <= used {
+					used -= n
+				}
+				break
+			}
+		}
+	}
+	return used, true
+}
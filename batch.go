@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// maxBatchSize is the max number of documents in a single /batch request
+const maxBatchSize = 1000
+
+// batchDoc is a document of a /batch request
+type batchDoc struct {
+	Name string `json:"name"`
+	HTML string `json:"html"`
+}
+
+// serveBatch handles POST /batch requests holding several html documents,
+// either as a JSON array of {"name", "html"} objects, or as multipart body
+// with one document per part named by its form name. Documents are converted
+// concurrently, and the reply is a ZIP archive with name.pdf file for each
+// document.
+func (h *handler) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if !h.accept(w, r) {
+		return
+	}
+	opts, err := h.requestOptions(r)
+	if err != nil || opts.sink != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	var docs []batchDoc
+	switch mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&docs); err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+	case "multipart/form-data":
+		if docs, err = readBatchParts(r); err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+	default:
+		h.error(w, http.StatusUnsupportedMediaType)
+		return
+	}
+	if len(docs) == 0 || len(docs) > maxBatchSize {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool, len(docs))
+	for i := range docs {
+		name := sanitizeFilename(strings.TrimSuffix(docs[i].Name, ".pdf"))
+		if name == "" {
+			name = "document-" + strconv.Itoa(i+1)
+		}
+		if seen[name] {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+		seen[name] = true
+		docs[i].Name = name + ".pdf"
+	}
+
+	results := make([]*result, len(docs))
+	errs := make([]error, len(docs))
+	defer func() {
+		for _, res := range results {
+			if res != nil {
+				res.Close()
+			}
+		}
+	}()
+	// limit number of documents of a single batch waiting in gate queue, so
+	// that large batches don't crowd out other requests
+	sem := make(chan struct{}, h.gate.limit())
+	var wg sync.WaitGroup
+	for i := range docs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = h.convert(r.Context(),
+				source{r: strings.NewReader(docs[i].HTML)}, opts)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			ctxLogger(r.Context()).Info("batch document failed", "name", docs[i].Name, "error", err)
+			h.conversionError(w, err)
+			return
+		}
+	}
+	h.policy.Load().addHeaders(w.Header())
+	w.Header().Set("Content-Type", "application/zip")
+	zw := zip.NewWriter(w)
+	now := time.Now()
+	for i, res := range results {
+		if fi, err := res.Stat(); err == nil {
+			h.limiter.account(h.clientKey(r), fi.Size(), h.limiter.countPages(r.Context(), res.File))
+		}
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: docs[i].Name, Method: zip.Deflate, Modified: now})
+		if err == nil {
+			_, err = io.Copy(f, res)
+		}
+		if err != nil {
+			ctxLogger(r.Context()).Info("writing batch reply failed", "error", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		ctxLogger(r.Context()).Info("writing batch reply failed", "error", err)
+	}
+}
+
+// readBatchParts reads html documents from multipart request body
+func readBatchParts(r *http.Request) ([]batchDoc, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	var docs []batchDoc
+	for len(docs) <= maxBatchSize {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		body, err := charset.NewReader(part, part.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, err
+		}
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(body); err != nil {
+			return nil, err
+		}
+		docs = append(docs, batchDoc{Name: part.FormName(), HTML: buf.String()})
+	}
+	return docs, nil
+}
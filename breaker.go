@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var errBreakerOpen = errors.New("renderer is failing, circuit breaker is open")
+
+// breaker is a circuit breaker for renderer: once threshold conversions in a
+// row fail, it opens, and conversions fail at once with errBreakerOpen. After
+// cooldown a single conversion is let through as a probe: breaker closes if
+// it succeeds, and stays open for another cooldown if it fails.
+type breaker struct {
+	name      string // renderer command, for logging
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int       // number of failed conversions in a row
+	until    time.Time // when open breaker lets a probe through
+	probing  bool      // whether probe conversion is running
+}
+
+// outcome of a conversion passed to breaker.done
+type outcome int
+
+const (
+	// conversion tells nothing about renderer health, i.e. it failed on a
+	// malformed document
+	outcomeUnknown outcome = iota
+	outcomeSuccess
+	// renderer could not start, crashed or hung
+	outcomeFailure
+)
+
+// allow returns errBreakerOpen if conversion must fail at once. Otherwise
+// caller must call done with returned probe once conversion is finished;
+// probe is true if conversion is the one let through open breaker. It's safe
+// to call on a nil breaker.
+func (b *breaker) allow() (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return false, nil
+	}
+	if b.probing || time.Now().Before(b.until) {
+		return false, errBreakerOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// done records outcome of a conversion allowed by allow. It's safe to call on
+// a nil breaker.
+func (b *breaker) done(probe bool, o outcome) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.failures >= b.threshold
+	if probe {
+		b.probing = false
+	}
+	switch o {
+	case outcomeSuccess:
+		if wasOpen {
+			slog.Info("renderer recovered, circuit breaker closed", "renderer", b.name)
+		}
+		b.failures = 0
+	case outcomeFailure:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.until = time.Now().Add(b.cooldown)
+			if !wasOpen {
+				slog.Error("renderer is failing, circuit breaker opened", "renderer", b.name,
+					"failures", b.failures)
+			}
+		}
+	}
+}
+
+// startFailed reports whether err means renderer command could not be
+// started at all
+func startFailed(err error) bool {
+	var ee *exec.Error
+	var pe *fs.PathError
+	return errors.As(err, &ee) || errors.As(err, &pe) && pe.Op == "fork/exec"
+}
+
+// isOpen reports whether breaker fails conversions. It's safe to call on a
+// nil breaker.
+func (b *breaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// resultCache keeps converted documents as files in a directory, evicting
+// least recently used ones once their total size exceeds max. Documents are
+// keyed by cacheKey.
+type resultCache struct {
+	dir string
+	max int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List // of *cacheEntry, most recently used at front
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// cacheFile matches names of files created by resultCache
+var cacheFile = regexp.MustCompile(`^[0-9a-f]{64}\.pdf$`)
+
+// newResultCache returns cache keeping files in dir. Documents cached in this
+// directory by previous runs are picked up, oldest first evicted.
+func newResultCache(dir string, max int64) (*resultCache, error) {
+	c := &resultCache{dir: dir, max: max, ll: list.New(), items: make(map[string]*list.Element)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !cacheFile.MatchString(e.Name()) {
+			continue
+		}
+		if fi, err := e.Info(); err == nil {
+			infos = append(infos, fi)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, fi := range infos {
+		c.add(fi.Name()[:64], fi.Size())
+	}
+	c.evict()
+	return c, nil
+}
+
+func (c *resultCache) path(key string) string { return filepath.Join(c.dir, key+".pdf") }
+
+// get returns opened cached document, or nil if there's none
+func (c *resultCache) get(key string) *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		c.remove(el)
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	return f
+}
+
+// put saves document read from r in cache
+func (c *resultCache) put(key string, r io.ReadSeeker) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	defer r.Seek(0, io.SeekStart)
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	size, err := io.Copy(f, r)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(f.Name(), c.path(key)); err != nil {
+		return err
+	}
+	if el, ok := c.items[key]; ok {
+		c.size -= el.Value.(*cacheEntry).size
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+	c.add(key, size)
+	c.evict()
+	return nil
+}
+
+// add registers entry as most recently used. It must be called with c.mu
+// held.
+func (c *resultCache) add(key string, size int64) {
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+}
+
+// evict removes least recently used entries until cache fits its max size.
+// It must be called with c.mu held.
+func (c *resultCache) evict() {
+	for c.size > c.max && c.ll.Len() != 0 {
+		c.remove(c.ll.Back())
+	}
+}
+
+// remove deletes entry and its file. It must be called with c.mu held.
+func (c *resultCache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.size -= e.size
+	os.Remove(c.path(e.key))
+}
+
+// cacheKey copies html document from r to w, returning key identifying
+// document converted from it by engine with options affecting its contents
+func cacheKey(w io.Writer, r io.Reader, engine string, opts options) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n%q\n%q\n%q\n%v %v %v %q %v %v\n", engine, opts.stylesheet(), opts.watermark, opts.meta,
+		opts.toc, opts.js, opts.jsDelay, opts.pageRange, opts.linearize, opts.optimize)
+	if _, err := io.Copy(w, io.TeeReader(r, h)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// callbackAttempts is the max number of attempts to deliver a callback
+const callbackAttempts = 5
+
+// callbackAllowed reports whether job status may be posted to u
+func (h *handler) callbackAllowed(u *url.URL) bool {
+	return h.policy.Load().callbackHosts[strings.ToLower(u.Hostname())]
+}
+
+// notify posts status of a finished job to callback url, retrying with
+// exponential backoff on failures. If handler has callback secret, payload is
+// signed with HMAC-SHA256, signature is sent in X-Pdf-Signature header as
+// sha256=<hex>.
+func (h *handler) notify(ctx context.Context, u *url.URL, j *job) {
+	payload := struct {
+		*job
+		Result string `json:"result,omitempty"`
+	}{job: j}
+	if j.Status == jobDone {
+		payload.Result = "/jobs/" + j.ID + "/result"
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		ctxLogger(ctx).Error("callback encoding failed", "job", j.ID, "error", err)
+		return
+	}
+	var signature string
+	if h.callbackSecret != "" {
+		mac := hmac.New(sha256.New, []byte(h.callbackSecret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	delay := time.Second
+	for i := 1; ; i++ {
+		err = postCallback(ctx, u, body, signature)
+		if err == nil {
+			return
+		}
+		if i == callbackAttempts {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	ctxLogger(ctx).Error("callback failed", "job", j.ID, "attempts", callbackAttempts, "error", err)
+}
+
+func postCallback(ctx context.Context, u *url.URL, body []byte, signature string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set("X-Pdf-Signature", signature)
+	}
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback replied with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+// Package client provides a client for pdfsvc http service.
+//
+// Usage example:
+//
+//	c := &client.Client{BaseURL: "http://localhost:8080", Token: token}
+//	pdf, err := c.ConvertHTML(ctx, strings.NewReader(doc),
+//		client.PageSize("A4"), client.Title("Invoice"))
+//	if err != nil {
+//		return err
+//	}
+//	defer pdf.Close()
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a pdfsvc client. Its zero value is not usable, BaseURL must be
+// set.
+type Client struct {
+	BaseURL string // service url, i.e. http://localhost:8080
+	Token   string // Bearer token, if service requires one
+
+	// HTTPClient is used to make requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+
+	// Retries is the number of times a request is retried on network
+	// errors and on 429, 502, 503 and 504 replies
+	Retries int
+}
+
+// Option sets conversion options of a request
+type Option func(http.Header)
+
+// Header sets arbitrary request header, i.e. option not covered by other
+// Option functions
+func Header(name, value string) Option { return func(h http.Header) { h.Set(name, value) } }
+
+// PageSize sets page size, i.e. A4 or Letter
+func PageSize(s string) Option { return Header("X-Pdf-Page-Size", s) }
+
+// Orientation sets page orientation: portrait or landscape
+func Orientation(s string) Option { return Header("X-Pdf-Orientation", s) }
+
+// Margins sets page margins as CSS lengths, i.e. 12.5mm
+func Margins(top, right, bottom, left string) Option {
+	return func(h http.Header) {
+		h.Set("X-Pdf-Margin-Top", top)
+		h.Set("X-Pdf-Margin-Right", right)
+		h.Set("X-Pdf-Margin-Bottom", bottom)
+		h.Set("X-Pdf-Margin-Left", left)
+	}
+}
+
+// Priority sets queue priority: high, normal or low
+func Priority(s string) Option { return Header("X-Pdf-Priority", s) }
+
+// Filename sets file name of the document in Content-Disposition reply
+// header; non-ASCII names are allowed
+func Filename(s string) Option { return Header("X-Pdf-Filename", s) }
+
+// DocID sets document id used in Content-Disposition filename
+func DocID(s string) Option { return Header("X-Pdf-Doc-Id", s) }
+
+// Title sets document title
+func Title(s string) Option { return Header("X-Pdf-Title", s) }
+
+// Author sets document author
+func Author(s string) Option { return Header("X-Pdf-Author", s) }
+
+// TableOfContents inserts table of contents listing document headings
+func TableOfContents() Option { return Header("X-Pdf-Toc", "true") }
+
+// JavaScript enables scripts in document; service must run Chromium and allow
+// scripts
+func JavaScript() Option { return Header("X-Pdf-Javascript", "true") }
+
+// JavaScriptDelay gives scripts in document time to finish before capture;
+// service must run Chromium and allow such delay
+func JavaScriptDelay(d time.Duration) Option { return Header("X-Pdf-Javascript-Delay", d.String()) }
+
+// UserStylesheet sets CSS applied on top of document styles. Line breaks are
+// replaced with spaces, as header values cannot have them.
+func UserStylesheet(css string) Option {
+	return Header("X-Pdf-User-Stylesheet", lineBreaks.Replace(css))
+}
+
+var lineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// WindowSize sets size of browser window in CSS pixels for Screenshot
+func WindowSize(width, height int) Option {
+	return Header("X-Pdf-Window-Size", strconv.Itoa(width)+"x"+strconv.Itoa(height))
+}
+
+// JPEG makes Screenshot reply with JPEG image of given quality, 1-100, instead
+// of PNG one; service default quality is used if it's 0
+func JPEG(quality int) Option {
+	return func(h http.Header) {
+		h.Set("X-Pdf-Image-Format", "jpeg")
+		if quality > 0 {
+			h.Set("X-Pdf-Image-Quality", strconv.Itoa(quality))
+		}
+	}
+}
+
+// Watermark sets text to stamp over each page
+func Watermark(s string) Option { return Header("X-Pdf-Watermark", s) }
+
+// Linearize optimizes document for fast web view
+func Linearize() Option { return Header("X-Pdf-Linearize", "true") }
+
+// Optimize recompresses document to reduce its size
+func Optimize() Option { return Header("X-Pdf-Optimize", "true") }
+
+// PageRange keeps only given pages of the document, i.e. "1-3,7"
+func PageRange(s string) Option { return Header("X-Pdf-Page-Range", s) }
+
+// Encrypt protects document with passwords; owner password may be empty, then
+// service generates a random one. Permissions are restrictions like no-print,
+// no-copy or no-modify.
+func Encrypt(userPassword, ownerPassword string, permissions ...string) Option {
+	return func(h http.Header) {
+		if userPassword != "" {
+			h.Set("X-Pdf-User-Password", userPassword)
+		}
+		if ownerPassword != "" {
+			h.Set("X-Pdf-Owner-Password", ownerPassword)
+		}
+		if len(permissions) != 0 {
+			h.Set("X-Pdf-Permissions", strings.Join(permissions, ","))
+		}
+	}
+}
+
+// Error is returned on non-successful service replies
+type Error struct {
+	StatusCode int
+	Message    string
+	Code       string        // machine-readable error code, if service reports one
+	RetryAfter time.Duration // set from Retry-After header, if any
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pdfsvc: %d %s", e.StatusCode, e.Message)
+}
+
+// ConvertHTML converts utf8-encoded html document read from r to PDF. Caller
+// must close returned reader.
+func (c *Client) ConvertHTML(ctx context.Context, r io.Reader, opts ...Option) (io.ReadCloser, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, "/", "text/html; charset=utf-8", body, opts)
+}
+
+// ConvertURL converts remote document at url to PDF. Service must be
+// configured to allow url host. Caller must close returned reader.
+func (c *Client) ConvertURL(ctx context.Context, url string, opts ...Option) (io.ReadCloser, error) {
+	body, err := json.Marshal(struct {
+		URL string `json:"url"`
+	}{url})
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, "/url", "application/json", body, opts)
+}
+
+// Screenshot renders utf8-encoded html document read from r in a browser
+// window and returns its PNG image; service must run Chromium. Use
+// WindowSize option to set window size, and JPEG option to get JPEG image.
+// Caller must close returned reader.
+func (c *Client) Screenshot(ctx context.Context, r io.Reader, opts ...Option) (io.ReadCloser, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, "/image", "text/html; charset=utf-8", body, opts)
+}
+
+// Validation is a result of Validate
+type Validation struct {
+	Valid    bool      `json:"valid"` // false if conversion would fail
+	Size     int       `json:"size"`
+	Charset  string    `json:"charset"`
+	Findings []Finding `json:"findings"`
+}
+
+// Finding is a problem found by Validate
+type Finding struct {
+	Severity string `json:"severity"` // "error" or "warning"
+	Check    string `json:"check"`
+	Message  string `json:"message"`
+}
+
+// Validate checks utf8-encoded html document read from r and conversion
+// options without converting the document.
+func (c *Client) Validate(ctx context.Context, r io.Reader, opts ...Option) (*Validation, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := c.do(ctx, "/validate", "text/html; charset=utf-8", body, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	v := &Validation{}
+	if err := json.NewDecoder(rc).Decode(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *Client) do(ctx context.Context, path, contentType string, body []byte, opts []Option) (io.ReadCloser, error) {
+	if c.BaseURL == "" {
+		return nil, errors.New("pdfsvc: BaseURL is not set")
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+			strings.TrimSuffix(c.BaseURL, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		for _, opt := range opts {
+			opt(req.Header)
+		}
+		resp, err := hc.Do(req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp.Body, nil
+		}
+		if err == nil {
+			err = replyError(resp)
+			resp.Body.Close()
+		}
+		if attempt >= c.Retries || !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		delay := time.Duration(500<<attempt) * time.Millisecond
+		if e := (*Error)(nil); errors.As(err, &e) && e.RetryAfter > 0 {
+			delay = e.RetryAfter
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// replyError builds Error from non-successful reply
+func replyError(resp *http.Response) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	switch ct := resp.Header.Get("Content-Type"); {
+	case strings.HasPrefix(ct, "application/json"):
+		var v struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &v) == nil && v.Error != "" {
+			e.Message = v.Error
+		}
+		return e
+	case strings.HasPrefix(ct, "application/problem+json"):
+		var v struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+			Code   string `json:"code"`
+		}
+		if json.Unmarshal(b, &v) == nil {
+			e.Code = v.Code
+			switch {
+			case v.Detail != "":
+				e.Message = v.Detail
+			case v.Title != "":
+				e.Message = v.Title
+			}
+		}
+		return e
+	}
+	if b = bytes.TrimSpace(b); len(b) != 0 {
+		e.Message = string(b)
+	}
+	return e
+}
+
+// retryable reports whether request failed with err may be retried
+func retryable(err error) bool {
+	var e *Error
+	if !errors.As(err, &e) {
+		return true // network error
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
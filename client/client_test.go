@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// replies returns handler answering with given handlers in turn; once they're
+// exhausted, the last one is repeated. Number of served requests is stored
+// in n.
+func replies(n *atomic.Int32, hs ...http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		i := int(n.Add(1)) - 1
+		if i >= len(hs) {
+			i = len(hs) - 1
+		}
+		hs[i](w, r)
+	}
+}
+
+func status(code int, header ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(code)
+	}
+}
+
+func pdf(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/pdf")
+	io.WriteString(w, "%PDF-1.7\n")
+}
+
+func TestRetry(t *testing.T) {
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			var n atomic.Int32
+			srv := httptest.NewServer(replies(&n, status(code, "Retry-After", "1"), pdf))
+			defer srv.Close()
+			c := &Client{BaseURL: srv.URL, Retries: 2}
+			begin := time.Now()
+			rc, err := c.ConvertHTML(context.Background(), strings.NewReader("<p>hi"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			if d := time.Since(begin); d < time.Second {
+				t.Errorf("retried after %v, want Retry-After delay of 1s", d)
+			}
+			if got := n.Load(); got != 2 {
+				t.Errorf("got %d requests, want 2", got)
+			}
+			b, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(b), "%PDF-") {
+				t.Errorf("got body %q, want PDF", b)
+			}
+		})
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	var n atomic.Int32
+	srv := httptest.NewServer(replies(&n, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"unsupported page size"}`)
+	}, pdf))
+	defer srv.Close()
+	c := &Client{BaseURL: srv.URL, Retries: 3}
+	_, err := c.ConvertHTML(context.Background(), strings.NewReader("<p>hi"))
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("got error %v, want *Error", err)
+	}
+	if e.StatusCode != http.StatusBadRequest || e.Message != "unsupported page size" {
+		t.Errorf("got error %+v", e)
+	}
+	if got := n.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestCancelDuringBackoff(t *testing.T) {
+	var n atomic.Int32
+	srv := httptest.NewServer(replies(&n, status(http.StatusServiceUnavailable, "Retry-After", "60")))
+	defer srv.Close()
+	c := &Client{BaseURL: srv.URL, Retries: 3}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	_, err := c.ConvertHTML(ctx, strings.NewReader("<p>hi"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(begin); d > 5*time.Second {
+		t.Errorf("returned after %v, want soon after context is done", d)
+	}
+	if got := n.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestProblemError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"type":"about:blank","title":"Unprocessable Entity",`+
+			`"status":422,"detail":"renderer failed","code":"render_failed"}`)
+	}))
+	defer srv.Close()
+	c := &Client{BaseURL: srv.URL}
+	_, err := c.ConvertHTML(context.Background(), strings.NewReader("<p>hi"))
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("got error %v, want *Error", err)
+	}
+	want := Error{StatusCode: http.StatusUnprocessableEntity, Message: "renderer failed", Code: "render_failed"}
+	if *e != want {
+		t.Errorf("got error %+v, want %+v", *e, want)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressor gzips replies of compressible content types for clients
+// accepting gzip content encoding
+type compressor struct {
+	minSize int // replies shorter than this are sent as is
+}
+
+// compressibleTypes are media types of replies compressor compresses; text/*
+// types are compressed too
+var compressibleTypes = map[string]bool{
+	"application/pdf":          true,
+	"application/json":         true,
+	"application/problem+json": true,
+}
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// wrap wraps next handler, compressing its replies
+func (c *compressor) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// ranges refer to uncompressed document, so such requests are
+		// left alone
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" ||
+			!acceptsGzip(r.Header.Values("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, minSize: c.minSize}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsGzip reports whether Accept-Encoding header values allow gzip
+func acceptsGzip(values []string) bool {
+	accept := false
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(s), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+				continue
+			}
+			q := 1.0
+			if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+				var err error
+				if q, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+					q = 0
+				}
+			}
+			if coding != "*" {
+				// explicit gzip entry takes precedence over wildcard
+				return q > 0
+			}
+			accept = q > 0
+		}
+	}
+	return accept
+}
+
+// compressWriter decides whether to compress the reply once it knows its
+// headers and either its length or first minSize bytes of it
+type compressWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int          // status code passed to WriteHeader, 0 until called
+	buf     []byte       // body written before the decision is made
+	decided bool         // whether reply headers were sent
+	gz      *gzip.Writer // set if reply is compressed
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	if code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	if !w.compressible() {
+		w.decide(false)
+		return
+	}
+	if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+		w.decide(n >= w.minSize)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(b)
+	case w.decided:
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// compressible reports whether reply headers allow compressing it
+func (w *compressWriter) compressible() bool {
+	switch w.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	hdr := w.Header()
+	if hdr.Get("Content-Encoding") != "" || hdr.Get("Content-Range") != "" {
+		return false
+	}
+	mt, _, _ := mime.ParseMediaType(hdr.Get("Content-Type"))
+	return compressibleTypes[mt] || strings.HasPrefix(mt, "text/")
+}
+
+// decide sends reply headers, setting them up for compression if compress is
+// true, and then body buffered so far
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		hdr := w.Header()
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Del("Content-Length")
+		// compressed reply is a different representation, so its
+		// validator can only be weak
+		if etag := hdr.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			hdr.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// close sends whatever remains of the reply once handler is done
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			// handler wrote nothing
+			return
+		}
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(nil)
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+// Flush sends buffered body uncompressed, as a partial reply should reach
+// client without waiting for more of it
+func (w *compressWriter) Flush() {
+	if !w.decided && w.status != 0 {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (w *compressWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is a prefix of environment variables setting flag values, i.e.
+// PDFSVC_MAX_BODY_SIZE sets -max-body-size
+const envPrefix = "PDFSVC_"
+
+// envName returns name of environment variable setting the named flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyConfig sets flags of already parsed fs from the configuration file
+// named by -config flag and from PDFSVC_* environment variables. Environment
+// takes precedence over command line flags, which take precedence over the
+// file.
+func applyConfig(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	env := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			env[f.Name] = v
+		}
+	})
+	name := fs.Lookup("config").Value.String()
+	if v, ok := env["config"]; ok {
+		name = v
+	}
+	if name != "" {
+		entries, err := readConfig(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.key == "config" || fs.Lookup(e.key) == nil {
+				return fmt.Errorf("%s:%d: unknown key %q", name, e.line, e.key)
+			}
+			if _, ok := env[e.key]; ok || explicit[e.key] {
+				continue
+			}
+			for _, v := range e.values {
+				if err := fs.Set(e.key, v); err != nil {
+					return fmt.Errorf("%s:%d: %s: %w", name, e.line, e.key, err)
+				}
+			}
+		}
+	}
+	for k, v := range env {
+		if err := fs.Set(k, v); err != nil {
+			return fmt.Errorf("%s: %w", envName(k), err)
+		}
+	}
+	return nil
+}
+
+// configEntry is a key = value line of the configuration file
+type configEntry struct {
+	key    string
+	values []string // several for arrays
+	line   int
+}
+
+// readConfig reads configuration file in a flat subset of TOML: each
+// non-empty line is either a comment starting with #, or a key = value pair.
+// Values are basic or literal strings, numbers, booleans, or single-line
+// arrays of them. Tables are not supported.
+func readConfig(name string) ([]configEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []configEntry
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: key = value expected", name, n)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%s:%d: duplicate key %q", name, n, key)
+		}
+		seen[key] = true
+		values, err := parseConfigValue(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+		out = append(out, configEntry{key: key, values: values, line: n})
+	}
+	return out, sc.Err()
+}
+
+// parseConfigValue parses value of a configuration file line, which may be
+// followed by a comment
+func parseConfigValue(s string) ([]string, error) {
+	if rest, ok := strings.CutPrefix(s, "["); ok {
+		var values []string
+		for {
+			rest = strings.TrimSpace(rest)
+			if rest, ok = strings.CutPrefix(rest, "]"); ok {
+				return values, checkComment(rest)
+			}
+			v, tail, err := parseScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			tail = strings.TrimSpace(tail)
+			if rest, ok = strings.CutPrefix(tail, ","); ok {
+				continue
+			}
+			if !strings.HasPrefix(tail, "]") {
+				return nil, errors.New("malformed array")
+			}
+			rest = tail
+		}
+	}
+	v, rest, err := parseScalar(s)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, checkComment(rest)
+}
+
+// parseScalar parses a string, number or boolean value at the start of s,
+// returning it along with the rest of s
+func parseScalar(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				return v, s[i+1:], err
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case strings.HasPrefix(s, "'"):
+		v, rest, ok := strings.Cut(s[1:], "'")
+		if !ok {
+			return "", "", errors.New("unterminated string")
+		}
+		return v, rest, nil
+	}
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	v := s[:end]
+	if v != "true" && v != "false" {
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(v, "_", ""), 64); err != nil {
+			return "", "", fmt.Errorf("unsupported value %q, strings must be quoted", v)
+		}
+		v = strings.ReplaceAll(v, "_", "")
+	}
+	return v, s[end:], nil
+}
+
+func checkComment(s string) error {
+	if s = strings.TrimSpace(s); s != "" && !strings.HasPrefix(s, "#") {
+		return fmt.Errorf("unexpected %q after value", s)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string // nil if error is expected
+	}{
+		{`"plain"`, []string{"plain"}},
+		{`"with \"quotes\" and \\ # hash"`, []string{`with "quotes" and \ # hash`}},
+		{`"tab\there" # comment`, []string{"tab\there"}},
+		{`'C:\literal\path'`, []string{`C:\literal\path`}},
+		{`'a # b' # comment`, []string{"a # b"}},
+		{`42`, []string{"42"}},
+		{`1_000_000`, []string{"1000000"}},
+		{`2.5`, []string{"2.5"}},
+		{`true#comment`, []string{"true"}},
+		{`false`, []string{"false"}},
+		{`["a", 'b', 3]`, []string{"a", "b", "3"}},
+		{`[ "a,b" , "c]" ] # comment`, []string{"a,b", "c]"}},
+		{`[]`, []string{}},
+		{`bare`, nil},
+		{`"unterminated`, nil},
+		{`'unterminated`, nil},
+		{`"a" "b"`, nil},
+		{`"a" trailing`, nil},
+		{`["a" "b"]`, nil},
+		{`["a"`, nil},
+		{`[bare]`, nil},
+	} {
+		got, err := parseConfigValue(tc.in)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %q, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if len(got) != 0 || len(tc.want) != 0 {
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%s: got %q, want %q", tc.in, got, tc.want)
+			}
+		}
+	}
+}
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "pdfsvc.toml")
+	if err := os.WriteFile(name, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReadConfig(t *testing.T) {
+	name := writeConfig(t, "# comment\n\naddr = \"localhost:8080\"\n  workers=4 # trailing\nhosts = [\"a\", \"b\"]\n")
+	got, err := readConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configEntry{
+		{key: "addr", values: []string{"localhost:8080"}, line: 3},
+		{key: "workers", values: []string{"4"}, line: 4},
+		{key: "hosts", values: []string{"a", "b"}, line: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for _, text := range []string{
+		"[table]\n",
+		"= 1\n",
+		"a = 1\na = 2\n",
+		"a = bare\n",
+	} {
+		if _, err := readConfig(writeConfig(t, text)); err == nil {
+			t.Errorf("%q: got no error", text)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	file := writeConfig(t, "a = \"file\"\nb = \"file\"\nc = \"file\"\nd = \"file\"\nnets = [\"10.0.0.0/8\", \"192.0.2.1\"]\n")
+	newFlagSet := func() (*flag.FlagSet, map[string]*string, *netList) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		vals := make(map[string]*string)
+		for _, name := range []string{"a", "b", "c", "d"} {
+			vals[name] = fs.String(name, "default", "")
+		}
+		nets := new(netList)
+		fs.Var(nets, "nets", "")
+		fs.String("config", "", "")
+		return fs, vals, nets
+	}
+
+	fs, vals, nets := newFlagSet()
+	t.Setenv(envName("a"), "env")
+	t.Setenv(envName("b"), "env")
+	if err := fs.Parse([]string{"-config", file, "-a", "flag", "-c", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	// env > flag > file > default
+	for name, want := range map[string]string{"a": "env", "b": "env", "c": "flag", "d": "file"} {
+		if got := *vals[name]; got != want {
+			t.Errorf("-%s: got %q, want %q", name, got, want)
+		}
+	}
+	if got, want := nets.String(), "10.0.0.0/8,192.0.2.1/32"; got != want {
+		t.Errorf("-nets: got %q, want %q", got, want)
+	}
+
+	// config file may be named by environment
+	fs, vals, _ = newFlagSet()
+	t.Setenv(envName("config"), file)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	if got := *vals["d"]; got != "file" {
+		t.Errorf("-d: got %q, want %q", got, "file")
+	}
+
+	fs, _, _ = newFlagSet()
+	t.Setenv(envName("config"), writeConfig(t, "unknown = 1\n"))
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs); err == nil {
+		t.Error("unknown key is accepted")
+	}
+}
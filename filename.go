@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultFilename is used when filename pattern cannot be expanded
+const defaultFilename = "document.pdf"
+
+// filenameVar matches placeholders in filename patterns
+var filenameVar = regexp.MustCompile(`{[^{}]*}`)
+
+// checkFilenamePattern verifies that pattern only uses known placeholders:
+// {id}, substituted with X-Pdf-Doc-Id request header, and {date}, substituted
+// with current UTC date in YYYY-MM-DD format.
+func checkFilenamePattern(pattern string) error {
+	for _, s := range filenameVar.FindAllString(pattern, -1) {
+		if s != "{id}" && s != "{date}" {
+			return fmt.Errorf("unknown filename pattern placeholder: %s", s)
+		}
+	}
+	return nil
+}
+
+// docFilename expands filename pattern for a document. If pattern refers to
+// fields not set by request, or expands to an empty name, defaultFilename is
+// returned.
+func docFilename(pattern string, opts options, now time.Time) string {
+	var missing bool
+	name := filenameVar.ReplaceAllStringFunc(pattern, func(s string) string {
+		switch s {
+		case "{id}":
+			if opts.docID == "" {
+				missing = true
+			}
+			return opts.docID
+		case "{date}":
+			return now.UTC().Format("2006-01-02")
+		}
+		missing = true
+		return ""
+	})
+	if missing {
+		return defaultFilename
+	}
+	if name = sanitizeFilename(name); name == "" {
+		return defaultFilename
+	}
+	return name
+}
+
+// sanitizeFilename makes s safe to use as a file name: it drops control
+// characters, replaces path separators and strips leading dots and spaces, so
+// that result cannot be interpreted as a path or a hidden file.
+func sanitizeFilename(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), r == unicode.ReplacementChar:
+			return -1
+		case r == '/', r == '\\':
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.TrimRight(strings.TrimLeft(s, ". "), " ")
+}
+
+// maxFilenameLen is max length of X-Pdf-Filename value
+const maxFilenameLen = 255
+
+// parseFilename validates file name set by X-Pdf-Filename header, making it
+// safe with sanitizeFilename and adding .pdf extension if it's missing
+func parseFilename(s string) (string, error) {
+	if len(s) > maxFilenameLen {
+		return "", errors.New("filename is too long")
+	}
+	name := sanitizeFilename(s)
+	if name == "" {
+		return "", fmt.Errorf("invalid filename %q", s)
+	}
+	if !strings.EqualFold(filepath.Ext(name), ".pdf") {
+		name += ".pdf"
+	}
+	return name, nil
+}
+
+// contentDisposition returns Content-Disposition header value offering
+// document as an attachment with a given file name. Non-ASCII names are sent
+// RFC 5987 encoded in filename* parameter, with filename parameter holding
+// ASCII approximation for clients that don't support it.
+func contentDisposition(name string) string {
+	var fallback, encoded strings.Builder
+	ascii := true
+	for _, r := range name {
+		switch {
+		case r >= utf8.RuneSelf:
+			ascii = false
+			fallback.WriteByte('_')
+		case r == '"', r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	if ascii {
+		return `attachment; filename="` + fallback.String() + `"`
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; isAttrChar(c) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return `attachment; filename="` + fallback.String() + `"; filename*=UTF-8''` + encoded.String()
+}
+
+// isAttrChar reports whether c can appear in RFC 5987 ext-value unencoded
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
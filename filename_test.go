@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDocFilename(t *testing.T) {
+	now := time.Date(2024, 3, 1, 23, 30, 0, 0, time.FixedZone("", -2*60*60))
+	for _, tc := range []struct {
+		pattern, id, want string
+	}{
+		{"invoice.pdf", "", "invoice.pdf"},
+		{"invoice-{id}.pdf", "42", "invoice-42.pdf"},
+		{"invoice-{date}.pdf", "", "invoice-2024-03-02.pdf"},
+		{"invoice-{id}-{date}.pdf", "42", "invoice-42-2024-03-02.pdf"},
+		{"invoice-{id}.pdf", "", defaultFilename},
+		{"invoice-{name}.pdf", "42", defaultFilename},
+		{"{id}", "../../etc/passwd", "_.._etc_passwd"},
+		{"{id}", "..", defaultFilename},
+		{"{id}.pdf", "a\r\nb\x00", "ab.pdf"},
+	} {
+		if got := docFilename(tc.pattern, options{docID: tc.id}, now); got != tc.want {
+			t.Errorf("docFilename(%q) with id %q = %q, want %q", tc.pattern, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestCheckFilenamePattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		wantErr bool
+	}{
+		{"invoice.pdf", false},
+		{"invoice-{id}-{date}.pdf", false},
+		{"invoice-{name}.pdf", true},
+		{"invoice-{}.pdf", true},
+	} {
+		if err := checkFilenamePattern(tc.pattern); (err != nil) != tc.wantErr {
+			t.Errorf("checkFilenamePattern(%q): got error %v, want error %v", tc.pattern, err, tc.wantErr)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"a/b\\c.pdf", "a_b_c.pdf"},
+		{"../../x.pdf", "_.._x.pdf"},
+		{".hidden.pdf", "hidden.pdf"},
+		{" . .x ", "x"},
+		{"a\tb\x7fc\u0085d.pdf", "abcd.pdf"},
+		{"bad\xffutf8.pdf", "badutf8.pdf"},
+		{"счёт.pdf", "счёт.pdf"},
+		{"...", ""},
+	} {
+		if got := sanitizeFilename(tc.in); got != tc.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseFilename(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "report", want: "report.pdf"},
+		{in: "report.PDF", want: "report.PDF"},
+		{in: "report.txt", want: "report.txt.pdf"},
+		{in: "/etc/passwd", want: "_etc_passwd.pdf"},
+		{in: "..", wantErr: true},
+		{in: "\x00\x01", wantErr: true},
+		{in: strings.Repeat("a", maxFilenameLen), want: strings.Repeat("a", maxFilenameLen) + ".pdf"},
+		{in: strings.Repeat("a", maxFilenameLen+1), wantErr: true},
+	} {
+		got, err := parseFilename(tc.in)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("parseFilename(%q) = %q, want error", tc.in, got)
+		case !tc.wantErr && err != nil:
+			t.Errorf("parseFilename(%q): %v", tc.in, err)
+		case got != tc.want:
+			t.Errorf("parseFilename(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"report.pdf", `attachment; filename="report.pdf"`},
+		{`a "quoted" \name.pdf`, `attachment; filename="a \"quoted\" \\name.pdf"`},
+		{"счёт 1.pdf", `attachment; filename="____ 1.pdf"; filename*=UTF-8''%D1%81%D1%87%D1%91%D1%82%201.pdf`},
+		{"naïve's.pdf", `attachment; filename="na_ve's.pdf"; filename*=UTF-8''na%C3%AFve%27s.pdf`},
+	} {
+		if got := contentDisposition(tc.name); got != tc.want {
+			t.Errorf("contentDisposition(%q) = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
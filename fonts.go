@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fontSet manages fonts directory added to fontconfig configuration of
+// renderers
+type fontSet struct {
+	dir string
+
+	mu    sync.Mutex // serializes changes of the directory
+	stamp string     // changes along with directory contents, see refresh
+}
+
+// loadFonts makes renderers use fonts from dir in addition to system ones:
+// it writes fontconfig configuration including dir and points
+// FONTCONFIG_FILE environment variable inherited by renderers to it.
+func loadFonts(dir string) (*fontSet, error) {
+	for _, name := range []string{"fc-cache", "fc-list"} {
+		if _, err := exec.LookPath(name); err != nil {
+			return nil, fmt.Errorf("-fonts-dir requires fontconfig tools: %w", err)
+		}
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var conf bytes.Buffer
+	conf.WriteString("<?xml version=\"1.0\"?>\n<!DOCTYPE fontconfig SYSTEM \"fonts.dtd\">\n<fontconfig>\n")
+	if base := os.Getenv("FONTCONFIG_FILE"); base != "" {
+		fmt.Fprintf(&conf, "<include ignore_missing=\"yes\">%s</include>\n", xmlEscape(base))
+	} else {
+		conf.WriteString("<include ignore_missing=\"yes\">/etc/fonts/fonts.conf</include>\n")
+	}
+	fmt.Fprintf(&conf, "<dir>%s</dir>\n</fontconfig>\n", xmlEscape(dir))
+	f, err := os.CreateTemp("", "pdfsvc-fonts-*.conf")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(conf.Bytes()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	os.Setenv("FONTCONFIG_FILE", f.Name())
+	fset := &fontSet{dir: dir}
+	if err := fset.refresh(); err != nil {
+		return nil, err
+	}
+	return fset, nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xmlEscaper.WriteString(&b, s)
+	return b.String()
+}
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// refresh rebuilds fontconfig cache of the directory and updates stamp
+func (fset *fontSet) refresh() error {
+	fset.mu.Lock()
+	defer fset.mu.Unlock()
+	return fset.refreshLocked()
+}
+
+func (fset *fontSet) refreshLocked() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, "fc-cache", fset.dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("fc-cache: %w: %s", err, bytes.TrimSpace(out))
+	}
+	entries, err := os.ReadDir(fset.dir)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(h, "%q %d %d\n", e.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	fset.stamp = hex.EncodeToString(h.Sum(nil)[:8])
+	return nil
+}
+
+// version returns a string that changes whenever fonts in the directory
+// change, so that documents rendered with different fonts are cached apart.
+// It's safe to call on a nil fontSet.
+func (fset *fontSet) version() string {
+	if fset == nil {
+		return ""
+	}
+	fset.mu.Lock()
+	defer fset.mu.Unlock()
+	return fset.stamp
+}
+
+// validFontName matches names of font files managed at /fonts/
+var validFontName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}\.(ttf|otf|ttc)$`)
+
+// errFontFormat is returned by put on data that is not a TrueType or
+// OpenType font
+var errFontFormat = errors.New("not a TrueType or OpenType font")
+
+// put saves font file under a given name, replacing existing one if there is
+func (fset *fontSet) put(name string, data []byte) error {
+	switch {
+	case bytes.HasPrefix(data, []byte{0, 1, 0, 0}),
+		bytes.HasPrefix(data, []byte("OTTO")),
+		bytes.HasPrefix(data, []byte("true")),
+		bytes.HasPrefix(data, []byte("ttcf")):
+	default:
+		return errFontFormat
+	}
+	f, err := os.CreateTemp(fset.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fset.mu.Lock()
+	defer fset.mu.Unlock()
+	if err := os.Rename(f.Name(), filepath.Join(fset.dir, name)); err != nil {
+		return err
+	}
+	return fset.refreshLocked()
+}
+
+// remove deletes the named font file
+func (fset *fontSet) remove(name string) error {
+	fset.mu.Lock()
+	defer fset.mu.Unlock()
+	if err := os.Remove(filepath.Join(fset.dir, name)); err != nil {
+		return err
+	}
+	return fset.refreshLocked()
+}
+
+// families returns sorted names of font families available to renderers
+func (fset *fontSet) families(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "fc-list", "--format", "%{family[0]}\n").Output()
+	if err != nil {
+		return nil, fmt.Errorf("fc-list: %w", err)
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range strings.Split(string(out), "\n") {
+		if s = strings.TrimSpace(s); s != "" && !seen[s] {
+			seen[s] = true
+			names = append(names, s)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// serveFonts handles GET /fonts requests, replying with JSON list of font
+// families available to renderers
+func (h *handler) serveFonts(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		h.error(w, http.StatusMethodNotAllowed)
+		return
+	}
+	names, err := h.fonts.families(r.Context())
+	if err != nil {
+		ctxLogger(r.Context()).Error("listing fonts failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Families []string `json:"families"`
+	}{names})
+}
+
+// maxFontSize limits size of uploaded font files
+const maxFontSize = 32 << 20
+
+// serveFont handles PUT and DELETE requests to /fonts/{name}, which upload
+// and delete font files in fonts directory. It's served at admin listener
+// only, see adminHandler.
+func (h *handler) serveFont(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/fonts/")
+	if !validFontName.MatchString(name) {
+		h.error(w, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFontSize))
+		if err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+		if err := h.fonts.put(name, data); err != nil {
+			if errors.Is(err, errFontFormat) {
+				h.error(w, http.StatusBadRequest)
+				return
+			}
+			ctxLogger(r.Context()).Error("saving font failed", "font", name, "error", err)
+			h.error(w, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := h.fonts.remove(name); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				h.error(w, http.StatusNotFound)
+				return
+			}
+			ctxLogger(r.Context()).Error("removing font failed", "font", name, "error", err)
+			h.error(w, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		h.error(w, http.StatusMethodNotAllowed)
+	}
+}
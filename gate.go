@@ -0,0 +1,337 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priority of a conversion request
+type priority int
+
+const (
+	priorityLow    priority = -1
+	priorityNormal priority = 0
+	priorityHigh   priority = 1
+)
+
+func parsePriority(s string) (priority, error) {
+	switch s {
+	case "", "normal":
+		return priorityNormal, nil
+	case "high":
+		return priorityHigh, nil
+	case "low":
+		return priorityLow, nil
+	}
+	return priorityNormal, errors.New("unsupported priority value")
+}
+
+// parsePriorityMap parses comma-separated list of name:priority pairs, i.e.
+// "nightly:low,app:high"
+func parsePriorityMap(s string) (map[string]priority, error) {
+	var m map[string]priority
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(kv, ":")
+		if !ok || name == "" || val == "" {
+			return nil, fmt.Errorf("invalid name:priority pair %q", kv)
+		}
+		p, err := parsePriority(val)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", kv, err)
+		}
+		if m == nil {
+			m = make(map[string]priority)
+		}
+		m[name] = p
+	}
+	return m, nil
+}
+
+func (p priority) String() string {
+	switch p {
+	case priorityHigh:
+		return "high"
+	case priorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+// gate limits number of concurrent conversions. Requests waiting for a free
+// slot are served in order of their arrival time, adjusted by priority: each
+// priority level counts as if request arrived aging earlier than a request of
+// the level below. This way higher priority requests jump the queue, while
+// low priority requests are never overtaken by requests that arrived more
+// than 2*aging later.
+type gate struct {
+	aging time.Duration
+
+	mu    sync.Mutex
+	free  int // number of free slots, negative after size was reduced
+	queue waitQueue
+	depth [3]int    // number of queued requests per priority
+	full  time.Time // since when all slots are taken, zero if some are free
+	size  int       // total number of slots
+
+	maxQueue int           // max number of queued requests, unlimited if 0
+	maxWait  time.Duration // max time request may stay queued, unlimited if 0
+	shed     [2]int64      // number of requests rejected with errQueueFull and errQueueTimeout
+}
+
+var (
+	errQueueFull    = errors.New("conversion queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a conversion slot")
+)
+
+// shedRetryAfter is Retry-After value, in seconds, of replies to requests
+// failed with errQueueFull or errQueueTimeout
+const shedRetryAfter = 5
+
+func newGate(size int, aging time.Duration) *gate {
+	return &gate{free: size, size: size, aging: aging}
+}
+
+// acquire blocks until slot is available or ctx is canceled. If queue is at
+// its max length, it fails with errQueueFull at once, and with
+// errQueueTimeout if request stays queued for longer than max wait. On
+// success, caller must call release once it's done with the slot.
+func (g *gate) acquire(ctx context.Context, p priority) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	if g.free > 0 && len(g.queue) == 0 {
+		g.free--
+		if g.free == 0 {
+			g.full = time.Now()
+		}
+		g.mu.Unlock()
+		return nil
+	}
+	if g.maxQueue > 0 && len(g.queue) >= g.maxQueue {
+		g.shed[0]++
+		g.mu.Unlock()
+		return errQueueFull
+	}
+	w := &waiter{
+		key:   time.Now().Add(-time.Duration(p) * g.aging),
+		prio:  p,
+		ready: make(chan struct{}),
+	}
+	heap.Push(&g.queue, w)
+	g.depth[p+1]++
+	var timeout <-chan time.Time
+	if g.maxWait > 0 {
+		t := time.NewTimer(g.maxWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	g.mu.Unlock()
+	var expired bool
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	case <-timeout:
+		expired = true
+	}
+	g.mu.Lock()
+	select {
+	case <-w.ready:
+		// slot was handed over concurrently with cancelation or timeout
+		g.mu.Unlock()
+		if expired {
+			return nil
+		}
+		g.release()
+		return ctx.Err()
+	default:
+	}
+	heap.Remove(&g.queue, w.index)
+	g.depth[p+1]--
+	if expired {
+		g.shed[1]++
+		g.mu.Unlock()
+		return errQueueTimeout
+	}
+	g.mu.Unlock()
+	return ctx.Err()
+}
+
+// setQueueLimits sets max number of queued requests and max time request may
+// stay queued, zero values mean no limit. It only affects requests queued
+// after the call.
+func (g *gate) setQueueLimits(length int, wait time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxQueue, g.maxWait = length, wait
+}
+
+// shedCounts returns number of requests rejected because queue was full, and
+// because they were queued for too long
+func (g *gate) shedCounts() map[string]int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return map[string]int64{"queue_full": g.shed[0], "queue_timeout": g.shed[1]}
+}
+
+// release returns slot acquired by acquire, handing it over to the next
+// queued request if there's any.
+func (g *gate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.free < 0 || len(g.queue) == 0 {
+		g.free++
+		if g.free > 0 {
+			g.full = time.Time{}
+		}
+		return
+	}
+	w := heap.Pop(&g.queue).(*waiter)
+	g.depth[w.prio+1]--
+	close(w.ready)
+}
+
+// resize changes total number of slots. When it's reduced, slots that are
+// taken are not reclaimed, but new requests wait until enough slots are
+// released.
+func (g *gate) resize(size int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.free += size - g.size
+	g.size = size
+	for g.free > 0 && len(g.queue) != 0 {
+		w := heap.Pop(&g.queue).(*waiter)
+		g.depth[w.prio+1]--
+		close(w.ready)
+		g.free--
+	}
+	switch {
+	case g.free > 0:
+		g.full = time.Time{}
+	case g.full.IsZero():
+		g.full = time.Now()
+	}
+}
+
+// limit returns total number of slots
+func (g *gate) limit() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.size
+}
+
+// drain blocks until all slots are released and no requests are queued, or
+// until ctx is canceled.
+func (g *gate) drain(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		g.mu.Lock()
+		idle := g.free == g.size && len(g.queue) == 0
+		g.mu.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// saturated reports whether all slots have been taken for at least d
+func (g *gate) saturated(d time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !g.full.IsZero() && time.Since(g.full) >= d
+}
+
+// queueDepths returns number of queued requests per priority
+func (g *gate) queueDepths() map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make(map[string]int, len(g.depth))
+	for i, n := range g.depth {
+		out[priority(i-1).String()] = n
+	}
+	return out
+}
+
+type waiter struct {
+	key   time.Time // arrival time adjusted by priority
+	prio  priority
+	ready chan struct{} // closed when slot is handed over to waiter
+	index int           // index in waitQueue
+}
+
+// waitQueue implements heap.Interface, ordering waiters by their keys
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int           { return len(q) }
+func (q waitQueue) Less(i, j int) bool { return q[i].key.Before(q[j].key) }
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waitQueue) Pop() any {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return w
+}
+
+// gateState describes slots and queue of a gate at some moment
+type gateState struct {
+	Slots  int            `json:"slots"`
+	Busy   int            `json:"busy"`
+	Queued []queuedWaiter `json:"queued"` // in order they would get slots
+}
+
+type queuedWaiter struct {
+	Priority string  `json:"priority"`
+	Waiting  float64 `json:"waiting_seconds"`
+}
+
+// idle reports whether caller holding a slot is the only one using the gate
+func (g *gate) idle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.size-g.free <= 1 && len(g.queue) == 0
+}
+
+// state returns current state of the gate
+func (g *gate) state() gateState {
+	now := time.Now()
+	g.mu.Lock()
+	q := make(waitQueue, len(g.queue))
+	copy(q, g.queue)
+	st := gateState{Slots: g.size, Busy: g.size - g.free}
+	g.mu.Unlock()
+	sort.Slice(q, func(i, j int) bool { return q[i].key.Before(q[j].key) })
+	st.Queued = make([]queuedWaiter, len(q))
+	for i, w := range q {
+		// key is arrival time shifted by priority
+		arrived := w.key.Add(time.Duration(w.prio) * g.aging)
+		st.Queued[i] = queuedWaiter{Priority: w.prio.String(), Waiting: now.Sub(arrived).Seconds()}
+	}
+	return st
+}
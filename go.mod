@@ -1,15 +1,15 @@
 module github.com/Doist/pdfsvc
 
-go 1.20
+go 1.24
 
 require (
 	github.com/artyom/autoflags v1.1.0
 	github.com/artyom/buffering v1.0.0
+	github.com/artyom/bytesize v0.0.0-20170915114729-c9e755de1330
 	github.com/artyom/exitstatus v0.0.0-20170915120126-0a657065c12f
 	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d
 )
 
 require (
-	github.com/artyom/bytesize v0.0.0-20170915114729-c9e755de1330 // indirect
 	golang.org/x/text v0.3.8 // indirect
 )
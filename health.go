@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+)
+
+// serveHealth handles /healthz requests, it replies with 200 OK as long as
+// the service is able to serve requests at all.
+func (h *handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// serveReady handles /readyz requests. Service is reported as not ready if
+// the renderer command cannot be found, if renderer circuit breaker is open,
+// or if all conversion slots have been busy for longer than the saturation
+// threshold.
+func (h *handler) serveReady(w http.ResponseWriter, r *http.Request) {
+	if _, err := exec.LookPath(h.renderer.command()); err != nil {
+		http.Error(w, "renderer not found", http.StatusServiceUnavailable)
+		return
+	}
+	if h.breaker.isOpen() {
+		http.Error(w, "renderer is failing", http.StatusServiceUnavailable)
+		return
+	}
+	if h.saturation > 0 && h.gate.saturated(h.saturation) {
+		http.Error(w, "all conversion slots are busy", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// imageTypes maps media types of images accepted as input to file name
+// extensions
+var imageTypes = map[string]string{
+	"image/svg+xml": ".svg",
+	"image/png":     ".png",
+	"image/jpeg":    ".jpg",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+}
+
+// imagePage is an html document wrapping image, scaled down to fit a single
+// page
+const imagePage = `<!doctype html>
+<html><head><meta charset="utf-8"><style>
+html, body { margin: 0; height: 100% }
+img { display: block; margin: auto; max-width: 100%; max-height: 100vh; object-fit: contain; break-inside: avoid }
+</style></head><body><img src="IMAGE"></body></html>
+`
+
+// serveImage handles requests with image bodies: image is wrapped in an html
+// document and converted to a single page PDF
+func (h *handler) serveImage(w http.ResponseWriter, r *http.Request) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	dir, err := os.MkdirTemp("", "pdfsvc-image-")
+	if err != nil {
+		ctxLogger(r.Context()).Error("creating image directory failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	image := "image" + imageTypes[mt]
+	if err := writeFile(filepath.Join(dir, image), r.Body); err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	index := filepath.Join(dir, indexFile)
+	if err := os.WriteFile(index, []byte(strings.Replace(imagePage, "IMAGE", image, 1)), 0600); err != nil {
+		ctxLogger(r.Context()).Error("writing image page failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	h.serveConverted(w, r, source{file: index})
+}
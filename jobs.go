@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// job statuses
+const (
+	jobQueued = "queued"
+	jobDone   = "done"
+	jobFailed = "failed"
+)
+
+// job is an asynchronous conversion
+type job struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	data     []byte // converted document, if kept in memory
+	file     string // name of file with converted document, if kept on disk
+	filename string // Content-Disposition file name of the result, if set
+	size     int64  // size of the result, accounted in jobStore.size
+}
+
+// jobStore keeps asynchronous conversion jobs. Results of finished jobs are
+// kept for the retention period, either in memory, or in files if dir is
+// set.
+type jobStore struct {
+	dir       string
+	retention time.Duration
+	max       int   // max number of unfinished jobs
+	maxSize   int64 // max total size of kept results
+
+	mu      sync.Mutex
+	jobs    map[string]*job
+	pending int
+	size    int64 // total size of kept results
+}
+
+func newJobStore(dir string, retention time.Duration, max int, maxSize int64) *jobStore {
+	return &jobStore{dir: dir, retention: retention, max: max, maxSize: maxSize, jobs: make(map[string]*job)}
+}
+
+var (
+	errTooManyJobs = errors.New("too many unfinished jobs")
+	errJobsFull    = errors.New("no room left for job results")
+)
+
+// add registers a new queued job, its result is served as a file with a
+// given name if it's not empty
+func (s *jobStore) add(filename string) (*job, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	j := &job{ID: hex.EncodeToString(b), Status: jobQueued, filename: filename}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max > 0 && s.pending >= s.max {
+		return nil, errTooManyJobs
+	}
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		return nil, errJobsFull
+	}
+	s.pending++
+	s.jobs[j.ID] = j
+	return j, nil
+}
+
+// finish stores conversion result of a job and schedules its removal after
+// the retention period. Job fails if its result doesn't fit into maxSize.
+func (s *jobStore) finish(j *job, res *result, err error) {
+	var data []byte
+	var file string
+	var size int64
+	if res != nil {
+		defer res.Close()
+	}
+	if err == nil {
+		size, err = s.reserve(res)
+	}
+	if err == nil {
+		if s.dir != "" {
+			file = filepath.Join(s.dir, j.ID+".pdf")
+			err = writeFile(file, res)
+		} else {
+			data, err = io.ReadAll(res)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	if err != nil {
+		// result is not kept after all
+		s.size -= size
+		size = 0
+	}
+	j.size = size
+	switch err {
+	case nil:
+		j.Status, j.data, j.file = jobDone, data, file
+	case errJobsFull:
+		j.Status, j.Error = jobFailed, "no room left for job results"
+	case context.DeadlineExceeded:
+		j.Status, j.Error = jobFailed, "conversion timed out"
+	default:
+		j.Status, j.Error = jobFailed, "conversion failed"
+	}
+	time.AfterFunc(s.retention, func() { s.remove(j.ID) })
+}
+
+// reserve accounts size of res in total size of kept results and returns
+// it, or returns errJobsFull if it doesn't fit
+func (s *jobStore) reserve(res *result) (int64, error) {
+	fi, err := res.Stat()
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSize > 0 && s.size+fi.Size() > s.maxSize {
+		return 0, errJobsFull
+	}
+	s.size += fi.Size()
+	return fi.Size(), nil
+}
+
+func (s *jobStore) remove(id string) {
+	s.mu.Lock()
+	j := s.jobs[id]
+	delete(s.jobs, id)
+	if j != nil {
+		s.size -= j.size
+	}
+	s.mu.Unlock()
+	if j != nil && j.file != "" {
+		os.Remove(j.file)
+	}
+}
+
+// get returns a copy of the job with a given id, or nil if there's no such
+// job.
+func (s *jobStore) get(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	j2 := *j
+	return &j2
+}
+
+// serveJobs handles POST /jobs requests: html document from request body is
+// queued for conversion and reply holds job status with its id.
+func (h *handler) serveJobs(w http.ResponseWriter, r *http.Request) {
+	if !h.accept(w, r) {
+		return
+	}
+	src, ok := h.htmlSource(w, r)
+	if !ok {
+		return
+	}
+	opts, err := h.requestOptions(r)
+	if err != nil || opts.sink != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if opts.callback != nil && !h.callbackAllowed(opts.callback) {
+		h.error(w, http.StatusForbidden)
+		return
+	}
+	data, err := io.ReadAll(src.r)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if h.policy.Load().perKB > 0 {
+		opts.timeout = h.scaledTimeout(int64(len(data)))
+	}
+	j, err := h.jobs.add(opts.filename)
+	if err != nil {
+		if err != errTooManyJobs && err != errJobsFull {
+			ctxLogger(r.Context()).Error("job create failed", "error", err)
+		}
+		h.error(w, http.StatusServiceUnavailable)
+		return
+	}
+	status := *j
+	key := h.clientKey(r)
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		res, err := h.convert(ctx, source{r: bytes.NewReader(data)}, opts)
+		if err != nil && h.noisy.Load() {
+			ctxLogger(ctx).Info("job failed", "job", j.ID, "error", err)
+		}
+		if err == nil {
+			if fi, err := res.Stat(); err == nil {
+				h.limiter.account(key, fi.Size(), h.limiter.countPages(ctx, res.File))
+			}
+		}
+		h.jobs.finish(j, res, err)
+		if opts.callback != nil {
+			h.notify(ctx, opts.callback, h.jobs.get(j.ID))
+		}
+	}()
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// serveJob handles GET /jobs/{id} requests replying with job status, and GET
+// /jobs/{id}/result requests replying with converted document.
+func (h *handler) serveJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		h.error(w, http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.checkAuth(w, r) {
+		return
+	}
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	j := h.jobs.get(id)
+	if j == nil || (sub != "" && sub != "result") {
+		h.error(w, http.StatusNotFound)
+		return
+	}
+	if sub == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(j)
+		return
+	}
+	if j.Status != jobDone {
+		h.error(w, http.StatusConflict)
+		return
+	}
+	name := j.filename
+	if s := r.URL.Query().Get("filename"); s != "" {
+		var err error
+		if name, err = parseFilename(s); err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+	}
+	var rd io.ReadSeeker = bytes.NewReader(j.data)
+	if j.file != "" {
+		f, err := os.Open(j.file)
+		if err != nil {
+			// file may be removed concurrently on job expiration
+			h.error(w, http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		rd = f
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	if name != "" {
+		w.Header().Set("Content-Disposition", contentDisposition(name))
+	}
+	http.ServeContent(w, r, "", time.Now(), rd)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtVerifier checks Bearer tokens that are JSON Web Tokens, signed either
+// with a shared secret (HS256), or with keys published at a JWKS url (RS256,
+// ES256).
+type jwtVerifier struct {
+	secret   []byte          // HS256 key, may be nil
+	keys     *keySet         // RS256 and ES256 keys, may be nil
+	issuer   string          // required iss claim, if set
+	audience string          // required aud claim, if set
+	scopes   map[string]bool // scopes token must have, may be nil
+}
+
+// jwtLeeway is clock skew allowed when checking exp and nbf claims
+const jwtLeeway = time.Minute
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"` // either a string or an array
+	Expires   *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Scope     string          `json:"scope"` // space-separated, RFC 8693
+	Scp       []string        `json:"scp"`   // used by some providers instead
+}
+
+// verify checks token signature and claims, returning its subject
+func (v *jwtVerifier) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	signed := token[:len(parts[0])+1+len(parts[1])]
+	// algorithm must match the kind of key, so that public keys are never
+	// used as HMAC secrets
+	switch hdr.Alg {
+	case "HS256":
+		if v.secret == nil {
+			return "", errors.New("unsupported algorithm " + hdr.Alg)
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		io.WriteString(mac, signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return "", errors.New("invalid signature")
+		}
+	case "RS256", "ES256":
+		if v.keys == nil {
+			return "", errors.New("unsupported algorithm " + hdr.Alg)
+		}
+		key, err := v.keys.get(hdr.Kid)
+		if err != nil {
+			return "", err
+		}
+		if err := verifySignature(hdr.Alg, key, signed, sig); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("unsupported algorithm " + hdr.Alg)
+	}
+	var c jwtClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return "", err
+	}
+	if c.Expires == nil || now.After(time.Unix(int64(*c.Expires), 0).Add(jwtLeeway)) {
+		return "", errors.New("token expired")
+	}
+	if c.NotBefore != nil && now.Before(time.Unix(int64(*c.NotBefore), 0).Add(-jwtLeeway)) {
+		return "", errors.New("token not yet valid")
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return "", errors.New("issuer mismatch")
+	}
+	if v.audience != "" && !c.hasAudience(v.audience) {
+		return "", errors.New("audience mismatch")
+	}
+	for s := range v.scopes {
+		if !c.hasScope(s) {
+			return "", errors.New("missing scope " + s)
+		}
+	}
+	return c.Subject, nil
+}
+
+func (c *jwtClaims) hasAudience(aud string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == aud
+	}
+	var many []string
+	if json.Unmarshal(c.Audience, &many) != nil {
+		return false
+	}
+	for _, s := range many {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *jwtClaims) hasScope(scope string) bool {
+	for _, s := range append(strings.Fields(c.Scope), c.Scp...) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes base64url-encoded JSON token segment into v
+func decodeSegment(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" && rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// signature is a concatenation of fixed size r and s values
+		if alg == "ES256" && len(sig) == 64 &&
+			ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// keySet holds public keys fetched from a JWKS url. Keys are refetched
+// periodically with run, and when a token refers to an unknown key, but no
+// more often than once a minute.
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by key id
+	fetched time.Time
+}
+
+// maxJWKSSize is max size of JWKS document
+const maxJWKSSize = 1 << 20
+
+func newKeySet(url string) (*keySet, error) {
+	ks := &keySet{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+	ks.fetched = time.Now()
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// run refetches keys every d
+func (ks *keySet) run(d time.Duration, onError func(error)) {
+	for range time.Tick(d) {
+		ks.mu.Lock()
+		ks.fetched = time.Now()
+		ks.mu.Unlock()
+		if err := ks.refresh(); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// get returns key with given id
+func (ks *keySet) get(kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	key, ok := ks.keys[kid]
+	stale := time.Since(ks.fetched) > time.Minute
+	if !ok && stale {
+		ks.fetched = time.Now()
+	}
+	ks.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, errors.New("unknown key " + kid)
+	}
+	// keys may have been rotated since the last fetch
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown key " + kid)
+}
+
+// refresh fetches keys from url, replacing previously fetched ones. On error,
+// old keys are kept.
+func (ks *keySet) refresh() error {
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status: %s", ks.url, resp.Status)
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&doc); err != nil {
+		return fmt.Errorf("%s: %w", ks.url, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// keys of unsupported types are skipped
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no supported keys found", ks.url)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	return nil
+}
+
+// jwk is a JSON Web Key, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 || n.BitLen() < 2048 {
+			return nil, errors.New("unsupported RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
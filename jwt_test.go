@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// signJWT returns token with given header and claims signed by key, which
+// is either an HMAC secret, or an RSA or ECDSA private key
+func signJWT(t *testing.T, hdr, claims map[string]any, key any) string {
+	t.Helper()
+	seg := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(hdr) + "." + seg(claims)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("s3cret")
+	now := time.Unix(1700000000, 0)
+	keys := &keySet{
+		keys: map[string]crypto.PublicKey{
+			"rsa": &rsaKey.PublicKey,
+			"ec":  &ecKey.PublicKey,
+		},
+		fetched: time.Now(), // unknown keys are not refetched
+	}
+	// rsaPub is what an attacker would use as an HMAC secret
+	rsaPub, err := json.Marshal(rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(kv ...any) map[string]any {
+		m := map[string]any{"sub": "alice", "exp": now.Add(time.Hour).Unix()}
+		for i := 0; i+1 < len(kv); i += 2 {
+			if kv[i+1] == nil {
+				delete(m, kv[i].(string))
+				continue
+			}
+			m[kv[i].(string)] = kv[i+1]
+		}
+		return m
+	}
+	hs := map[string]any{"alg": "HS256"}
+	for _, tc := range []struct {
+		name   string
+		v      *jwtVerifier
+		hdr    map[string]any
+		claims map[string]any
+		key    any
+		ok     bool
+	}{
+		{"hs256", &jwtVerifier{secret: secret}, hs, claims(), secret, true},
+		{"hs256 wrong secret", &jwtVerifier{secret: secret}, hs, claims(), []byte("other"), false},
+		{"rs256", &jwtVerifier{keys: keys}, map[string]any{"alg": "RS256", "kid": "rsa"}, claims(), rsaKey, true},
+		{"es256", &jwtVerifier{keys: keys}, map[string]any{"alg": "ES256", "kid": "ec"}, claims(), ecKey, true},
+		{"unknown kid", &jwtVerifier{keys: keys}, map[string]any{"alg": "RS256", "kid": "other"}, claims(), rsaKey, false},
+		{"alg none", &jwtVerifier{secret: secret, keys: keys}, map[string]any{"alg": "none"}, claims(), secret, false},
+
+		// algorithm must match the kind of configured key
+		{"hs256 with jwks only", &jwtVerifier{keys: keys}, map[string]any{"alg": "HS256", "kid": "rsa"}, claims(), rsaPub, false},
+		{"rs256 with secret only", &jwtVerifier{secret: secret}, map[string]any{"alg": "RS256", "kid": "rsa"}, claims(), rsaKey, false},
+		{"es256 header on rsa key", &jwtVerifier{keys: keys}, map[string]any{"alg": "ES256", "kid": "rsa"}, claims(), ecKey, false},
+		{"rs256 header on ec key", &jwtVerifier{keys: keys}, map[string]any{"alg": "RS256", "kid": "ec"}, claims(), rsaKey, false},
+
+		{"no exp", &jwtVerifier{secret: secret}, hs, claims("exp", nil), secret, false},
+		{"expired within leeway", &jwtVerifier{secret: secret}, hs, claims("exp", now.Add(-30*time.Second).Unix()), secret, true},
+		{"expired", &jwtVerifier{secret: secret}, hs, claims("exp", now.Add(-2*time.Minute).Unix()), secret, false},
+		{"nbf within leeway", &jwtVerifier{secret: secret}, hs, claims("nbf", now.Add(30*time.Second).Unix()), secret, true},
+		{"not yet valid", &jwtVerifier{secret: secret}, hs, claims("nbf", now.Add(2*time.Minute).Unix()), secret, false},
+
+		{"aud string", &jwtVerifier{secret: secret, audience: "pdfsvc"}, hs, claims("aud", "pdfsvc"), secret, true},
+		{"aud array", &jwtVerifier{secret: secret, audience: "pdfsvc"}, hs, claims("aud", []string{"other", "pdfsvc"}), secret, true},
+		{"aud string mismatch", &jwtVerifier{secret: secret, audience: "pdfsvc"}, hs, claims("aud", "other"), secret, false},
+		{"aud array mismatch", &jwtVerifier{secret: secret, audience: "pdfsvc"}, hs, claims("aud", []string{"other"}), secret, false},
+		{"aud missing", &jwtVerifier{secret: secret, audience: "pdfsvc"}, hs, claims(), secret, false},
+
+		{"issuer", &jwtVerifier{secret: secret, issuer: "idp"}, hs, claims("iss", "idp"), secret, true},
+		{"issuer mismatch", &jwtVerifier{secret: secret, issuer: "idp"}, hs, claims("iss", "other"), secret, false},
+		{"scope", &jwtVerifier{secret: secret, scopes: map[string]bool{"pdf": true}}, hs, claims("scope", "read pdf"), secret, true},
+		{"scp", &jwtVerifier{secret: secret, scopes: map[string]bool{"pdf": true}}, hs, claims("scp", []string{"pdf"}), secret, true},
+		{"missing scope", &jwtVerifier{secret: secret, scopes: map[string]bool{"pdf": true}}, hs, claims("scope", "read"), secret, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sub, err := tc.v.verify(signJWT(t, tc.hdr, tc.claims, tc.key), now)
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sub != "alice" {
+				t.Errorf("got subject %q, want %q", sub, "alice")
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// concurrencyLimiter caps number of concurrent requests per client
+type concurrencyLimiter struct {
+	max int
+
+	mu    sync.Mutex
+	inUse map[string]int
+}
+
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	return &concurrencyLimiter{max: max, inUse: make(map[string]int)}
+}
+
+// acquire reports whether client identified by key is allowed to make one
+// more request. If so, caller must call release with the same key once
+// request is done.
+func (l *concurrencyLimiter) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inUse[key] >= l.max {
+		return false
+	}
+	l.inUse[key]++
+	return true
+}
+
+func (l *concurrencyLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inUse[key]--; l.inUse[key] <= 0 {
+		delete(l.inUse, key)
+	}
+}
+
+// usage returns number of in-flight requests per client
+func (l *concurrencyLimiter) usage() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]int, len(l.inUse))
+	for k, v := range l.inUse {
+		out[k] = v
+	}
+	return out
+}
+
+// limit wraps next handler, replying with 429 Too Many Requests to clients
+// already having max requests in flight.
+func (l *concurrencyLimiter) limit(h *handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := h.clientKey(r)
+		if !l.acquire(key) {
+			h.error(w, http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(key)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies client by its Bearer token, or by its IP address (see
+// clientIP) if request has no token. Only tokens accepted by authorized are
+// used, so that clients can't get a fresh key with every made up token; if no
+// tokens are configured, all clients are identified by address. Tokens are
+// represented by their names from the token file or by a short hash, so that
+// keys can be safely exposed in metrics and logs.
+func (h *handler) clientKey(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		if p := h.policy.Load(); h.authRequired(p) && h.checkToken(p, token) == nil {
+			if name := h.tokenName(r); name != "" {
+				return "token:" + name
+			}
+			sum := sha256.Sum256([]byte(token))
+			return "token:" + hex.EncodeToString(sum[:6])
+		}
+	}
+	return "ip:" + h.clientHost(r)
+}
+
+// tokenSlots limits concurrent conversions of named tokens that have slots
+// set in the token file. Each name gets its own gate, which conversions pass
+// before the global one.
+type tokenSlots struct {
+	aging time.Duration
+
+	mu    sync.Mutex
+	gates map[string]*gate
+}
+
+func newTokenSlots(aging time.Duration) *tokenSlots {
+	return &tokenSlots{aging: aging, gates: make(map[string]*gate)}
+}
+
+// gate returns gate of the named token, resizing it if the token file was
+// reloaded with a different number of slots
+func (s *tokenSlots) gate(name string, size int) *gate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.gates[name]
+	if g == nil {
+		g = newGate(size, s.aging)
+		s.gates[name] = g
+	} else if g.limit() != size {
+		g.resize(size)
+	}
+	return g
+}
+
+// usage returns number of conversion slots in use per token name
+func (s *tokenSlots) usage() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int, len(s.gates))
+	for name, g := range s.gates {
+		out[name] = g.state().Busy
+	}
+	return out
+}
+
+type tokenGateKey struct{}
+
+// tokenGate returns gate attached to ctx by handler.withTokenSlots, or nil
+func tokenGate(ctx context.Context) *gate {
+	g, _ := ctx.Value(tokenGateKey{}).(*gate)
+	return g
+}
+
+// withTokenSlots wraps next handler, attaching gate of the request token to
+// the request context, if token has slots limited in the token file
+func (h *handler) withTokenSlots(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, n := h.tokens.slots(bearerToken(r)); n > 0 {
+			ctx := context.WithValue(r.Context(), tokenGateKey{}, h.slots.gate(name, n))
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestTokens returns token set accepting given tokens
+func newTestTokens(t *testing.T, tokens ...string) *tokenSet {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(name, []byte(strings.Join(tokens, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := loadTokenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	const max = 2
+	h := newTestHandler(t, "", nil)
+	h.tokens = newTestTokens(t, "one", "two")
+	l := newConcurrencyLimiter(max)
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(l.limit(h, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+	})))
+	defer srv.Close()
+
+	get := func(token string) int {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	var wg sync.WaitGroup
+	codes := make([]int, max)
+	for i := 0; i < max; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = get("one")
+		}()
+		<-entered
+	}
+	if code := get("one"); code != http.StatusTooManyRequests {
+		t.Errorf("request over the cap: got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if got := l.usage()[h.clientKey(&http.Request{Header: http.Header{"Authorization": {"Bearer one"}}})]; got != max {
+		t.Errorf("got %d requests in use, want %d", got, max)
+	}
+
+	// other clients are not affected
+	wg.Add(1)
+	var other int
+	go func() {
+		defer wg.Done()
+		other = get("two")
+	}()
+	<-entered
+	close(unblock)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: got status %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	if other != http.StatusOK {
+		t.Errorf("request of other client: got status %d, want %d", other, http.StatusOK)
+	}
+	if u := l.usage(); len(u) != 0 {
+		t.Errorf("got requests in use after all finished: %v", u)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	req := func(token string) *http.Request {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+	h := newTestHandler(t, "", nil)
+	if got := h.clientKey(req("one")); got != "ip:192.0.2.1" {
+		t.Errorf("no auth configured: got key %q, want client address", got)
+	}
+	h.tokens = newTestTokens(t, "one", "two=billing")
+	for _, tc := range []struct {
+		token, want string
+	}{
+		{"", "ip:192.0.2.1"},
+		{"made-up", "ip:192.0.2.1"},
+		{"two", "token:billing"},
+	} {
+		if got := h.clientKey(req(tc.token)); got != tc.want {
+			t.Errorf("token %q: got key %q, want %q", tc.token, got, tc.want)
+		}
+	}
+	if got := h.clientKey(req("one")); !strings.HasPrefix(got, "token:") || strings.Contains(got, "one") {
+		t.Errorf("unnamed token: got key %q, want token hash", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listen listens on addr, which is either a TCP address, or a unix socket
+// path prefixed with "unix:", i.e. unix:/run/pdfsvc.sock
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// socket file may be left over by a process that didn't exit cleanly
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation
+const listenFdsStart = 3
+
+// activationListener returns listener passed by systemd socket activation
+// (see sd_listen_fds(3)), or nil if process was not started this way
+func activationListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// child processes must not see these
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		return nil, errors.New("socket activation: only one socket is supported, got " + strconv.Itoa(n))
+	}
+	syscall.CloseOnExec(listenFdsStart)
+	f := os.NewFile(listenFdsStart, "systemd socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
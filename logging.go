@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// setLogFormat makes slog default logger use the named format: "text" keeps
+// output of the log package, "json" writes one JSON object per line.
+func setLogFormat(format string) bool {
+	switch format {
+	case "text":
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	default:
+		return false
+	}
+	return true
+}
+
+type loggerKey struct{}
+
+// ctxLogger returns logger attached to ctx by withRequestID, or the default
+// logger
+func ctxLogger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// validRequestID matches request ids accepted from clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID wraps next handler, assigning each request an id, which is
+// either taken from X-Request-Id request header, or randomly generated. The id
+// is sent back in X-Request-Id response header, and is attached along with
+// client details to the logger available with ctxLogger.
+func (h *handler) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-Id", id)
+		l := slog.Default().With(
+			"request_id", id,
+			"remote_ip", h.clientHost(r),
+			"client", h.clientKey(r),
+			"content_length", r.ContentLength,
+		)
+		if traceID, spanID, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+			l = l.With("trace_id", traceID, "span_id", spanID)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+	})
+}
+
+// traceparent matches W3C Trace Context traceparent header value:
+// version-traceid-parentid-flags
+var traceparent = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}`)
+
+// parseTraceparent extracts trace and parent span ids from traceparent header
+// value, so that log messages can be correlated with distributed traces.
+func parseTraceparent(s string) (traceID, spanID string, ok bool) {
+	m := traceparent.FindStringSubmatch(s)
+	if m == nil || m[1] == "ff" || strings.Trim(m[2], "0") == "" || strings.Trim(m[3], "0") == "" {
+		return "", "", false
+	}
+	if m[1] == "00" && len(s) != 55 {
+		return "", "", false
+	}
+	return m[2], m[3], true
+}
+
+// processAttrs returns exit status and resource usage of a finished process
+// as log attributes
+func processAttrs(ps *os.ProcessState) []any {
+	if ps == nil {
+		return nil
+	}
+	attrs := []any{
+		"user", ps.UserTime().Round(time.Millisecond),
+		"sys", ps.SystemTime().Round(time.Millisecond),
+	}
+	if rss := maxRSS(ps); rss != 0 {
+		attrs = append(attrs, "max_rss", rss)
+	}
+	return attrs
+}
+
+// maxRSS returns peak resident set size of a finished process in bytes, or 0
+// if it's unknown
+func maxRSS(ps *os.ProcessState) int64 {
+	if ps == nil {
+		return 0
+	}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		return ru.Maxrss << 10 // Maxrss is in KiB on Linux
+	}
+	return 0
+}
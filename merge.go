@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// serveMerge handles POST /merge requests with multipart bodies: each part is
+// either an html document, which is converted, or a PDF document. Resulting
+// documents are concatenated in order of parts, and the reply holds a single
+// PDF document. Post-processing options are applied to the merged document
+// only.
+func (h *handler) serveMerge(w http.ResponseWriter, r *http.Request) {
+	if !h.accept(w, r) {
+		return
+	}
+	opts, err := h.requestOptions(r)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if opts.sink != nil && !h.sinkAllowed(opts.sink) {
+		h.error(w, http.StatusForbidden)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	l := ctxLogger(r.Context())
+	dir, err := os.MkdirTemp("", "pdfsvc-merge-")
+	if err != nil {
+		l.Error("creating merge directory failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	var names, warnings []string
+	total := &result{}
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+		name := filepath.Join(dir, strconv.Itoa(i)+".pdf")
+		ct := part.Header.Get("Content-Type")
+		mt, _, _ := mime.ParseMediaType(ct)
+		switch mt {
+		case "application/pdf":
+			if err := writeFile(name, part); err != nil {
+				l.Error("saving merge part failed", "error", err)
+				h.error(w, http.StatusInternalServerError)
+				return
+			}
+		case "text/html":
+			body, err := charset.NewReader(part, ct)
+			if err != nil {
+				h.error(w, http.StatusUnsupportedMediaType)
+				return
+			}
+			res, err := h.render(r.Context(), source{r: body}, opts)
+			if err != nil {
+				h.conversionError(w, err)
+				return
+			}
+			err = writeFile(name, res)
+			res.Close()
+			if err != nil {
+				l.Error("saving merge part failed", "error", err)
+				h.error(w, http.StatusInternalServerError)
+				return
+			}
+			total.queued += res.queued
+			total.rendered += res.rendered
+			if res.warning != "" {
+				warnings = append(warnings, res.warning)
+			}
+			total.warnings = append(total.warnings, res.warnings...)
+		default:
+			h.error(w, http.StatusUnsupportedMediaType)
+			return
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if total.File, err = mergePDFs(r.Context(), names); err != nil {
+		l.Info("merge failed", "error", err)
+		if errors.As(err, new(*exec.ExitError)) {
+			// qpdf could not process uploaded documents
+			h.error(w, http.StatusUnprocessableEntity)
+			return
+		}
+		h.conversionError(w, err)
+		return
+	}
+	defer total.Close()
+	if err := h.postProcess(r.Context(), total, opts); err != nil {
+		l.Error("post-processing failed", "error", err)
+		h.conversionError(w, err)
+		return
+	}
+	total.warning = strings.Join(warnings, "; ")
+	h.serveResult(w, r, opts, total)
+}
+
+// prependCover converts html document file as a cover page, and prepends it
+// to res
+func (h *handler) prependCover(ctx context.Context, res *result, cover string, opts options) error {
+	opts.toc = false
+	cres, err := h.render(ctx, source{file: cover}, opts)
+	if err != nil {
+		return err
+	}
+	defer cres.Close()
+	res.queued += cres.queued
+	res.rendered += cres.rendered
+	res.warnings = append(cres.warnings, res.warnings...)
+	switch {
+	case res.warning == "":
+		res.warning = cres.warning
+	case cres.warning != "":
+		res.warning = cres.warning + "; " + res.warning
+	}
+	dir, err := os.MkdirTemp("", "pdfsvc-merge-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	names := []string{filepath.Join(dir, "cover.pdf"), filepath.Join(dir, "document.pdf")}
+	for i, f := range [...]*os.File{cres.File, res.File} {
+		if err := writeFile(names[i], f); err != nil {
+			return err
+		}
+	}
+	merged, err := mergePDFs(ctx, names)
+	if err != nil {
+		return err
+	}
+	res.File.Close()
+	res.File = merged
+	return nil
+}
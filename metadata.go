@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+)
+
+// producer is stored as PDF producer of documents with metadata set
+const producer = "pdfsvc"
+
+// metadata is document information set with X-Pdf-Title, X-Pdf-Author,
+// X-Pdf-Subject and X-Pdf-Keywords headers. It is written to the PDF
+// document information dictionary with qpdf after conversion, so it's
+// applied the same way for all renderers and sources.
+type metadata struct {
+	title, author, subject, keywords string
+}
+
+func parseMetadata(hdr http.Header) metadata {
+	return metadata{
+		title:    hdr.Get("X-Pdf-Title"),
+		author:   hdr.Get("X-Pdf-Author"),
+		subject:  hdr.Get("X-Pdf-Subject"),
+		keywords: hdr.Get("X-Pdf-Keywords"),
+	}
+}
+
+func (m metadata) empty() bool { return m == metadata{} }
+
+// writeInfoUpdate saves to file name a qpdf --update-from-json update
+// setting document information of PDF file input to m
+func (m metadata) writeInfoUpdate(ctx context.Context, input, name string) error {
+	header, objs, err := qpdfObjects(ctx, input, "trailer")
+	if err != nil {
+		return err
+	}
+	trailer, ok := objs["trailer"].Value.(map[string]any)
+	if !ok {
+		return errors.New("qpdf: document has no trailer")
+	}
+	var info map[string]any
+	ref, _ := trailer["/Info"].(string)
+	if ref != "" {
+		var num, gen int
+		if _, err := fmt.Sscanf(ref, "%d %d R", &num, &gen); err != nil {
+			return fmt.Errorf("qpdf: invalid /Info reference %q", ref)
+		}
+		_, objs, err := qpdfObjects(ctx, input, fmt.Sprintf("%d,%d", num, gen))
+		if err != nil {
+			return err
+		}
+		info, _ = objs["obj:"+ref].Value.(map[string]any)
+	}
+	b, err := json.Marshal(map[string]any{"qpdf": []any{header, m.infoUpdate(header, trailer, ref, info)}})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0600)
+}
+
+// infoUpdate returns objects to update in document with given qpdf JSON
+// header and trailer, so that its document information is set to m. Current
+// document information dictionary, if any, is info referenced by ref; its
+// other entries are kept.
+func (m metadata) infoUpdate(header, trailer map[string]any, ref string, info map[string]any) map[string]qpdfObject {
+	info = maps.Clone(info)
+	if info == nil {
+		info = make(map[string]any)
+	}
+	for key, val := range map[string]string{
+		"/Title":    m.title,
+		"/Author":   m.author,
+		"/Subject":  m.subject,
+		"/Keywords": m.keywords,
+		"/Producer": producer,
+	} {
+		if val != "" {
+			// "u:" marks unicode text strings
+			info[key] = "u:" + val
+		}
+	}
+	update := make(map[string]qpdfObject)
+	if ref == "" {
+		// new objects are numbered past existing ones
+		maxID, _ := header["maxobjectid"].(float64)
+		ref = fmt.Sprintf("%d 0 R", int(maxID)+1)
+		trailer = maps.Clone(trailer)
+		trailer["/Info"] = ref
+		update["trailer"] = qpdfObject{trailer}
+	}
+	update["obj:"+ref] = qpdfObject{info}
+	return update
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"testing"
+)
+
+func TestInfoUpdate(t *testing.T) {
+	m := metadata{title: "Invoice", author: "Jane Roe"}
+	header := map[string]any{"jsonversion": 2.0, "maxobjectid": 12.0}
+	trailer := map[string]any{"/Root": "1 0 R", "/Size": 13.0}
+	for _, tc := range []struct {
+		name    string
+		trailer map[string]any
+		ref     string
+		info    map[string]any
+		want    map[string]qpdfObject
+	}{
+		{"existing info", trailer, "2 0 R",
+			map[string]any{"/Title": "u:untitled", "/CreationDate": "u:D:20260101000000Z"},
+			map[string]qpdfObject{
+				"obj:2 0 R": {map[string]any{"/Title": "u:Invoice", "/Author": "u:Jane Roe",
+					"/Producer": "u:pdfsvc", "/CreationDate": "u:D:20260101000000Z"}},
+			}},
+		{"no info", trailer, "", nil,
+			map[string]qpdfObject{
+				"obj:13 0 R": {map[string]any{"/Title": "u:Invoice", "/Author": "u:Jane Roe", "/Producer": "u:pdfsvc"}},
+				"trailer":    {map[string]any{"/Root": "1 0 R", "/Size": 13.0, "/Info": "13 0 R"}},
+			}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info := maps.Clone(tc.info)
+			got := m.infoUpdate(header, tc.trailer, tc.ref, info)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			if !reflect.DeepEqual(info, tc.info) {
+				t.Errorf("info changed to %v", info)
+			}
+		})
+	}
+	if _, ok := trailer["/Info"]; ok {
+		t.Error("trailer was modified")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// netList is a flag.Value collecting networks given in CIDR notation, or as
+// single addresses; values may be comma-separated and the flag repeated
+type netList []netip.Prefix
+
+func (l *netList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, len(*l))
+	for i, p := range *l {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *netList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return err
+			}
+			*l = append(*l, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return err
+		}
+		if p.Addr().Is4In6() {
+			return fmt.Errorf("%s: use IPv4 notation for IPv4 networks", v)
+		}
+		*l = append(*l, p.Masked())
+	}
+	return nil
+}
+
+// contains reports whether addr belongs to any of the networks
+func (l netList) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range l {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns address of the client that made the request. If request
+// came from one of the trusted proxies, client address is taken from
+// Forwarded or X-Forwarded-For header: it's the rightmost address not
+// belonging to trusted proxies, as addresses to the left of it may be forged
+// by the client.
+func (h *handler) clientIP(r *http.Request) netip.Addr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr := ap.Addr().Unmap()
+	trusted := h.policy.Load().trustedProxies
+	if !trusted.contains(addr) {
+		return addr
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		if addr = hop.Unmap(); !trusted.contains(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// clientHost returns text form of the client address as returned by
+// clientIP, or request RemoteAddr if it's not an IP address, i.e. for unix
+// socket connections
+func (h *handler) clientHost(r *http.Request) string {
+	if addr := h.clientIP(r); addr.IsValid() {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor returns addresses of the proxy chain listed in "for"
+// parameters of RFC 7239 Forwarded header, or in X-Forwarded-For header if
+// there's no Forwarded one. Elements with no address are returned as empty
+// strings.
+func forwardedFor(hdr http.Header) []string {
+	vals := hdr.Values("Forwarded")
+	if len(vals) == 0 {
+		return strings.Split(strings.Join(hdr.Values("X-Forwarded-For"), ","), ",")
+	}
+	var hops []string
+	for _, elem := range strings.Split(strings.Join(vals, ","), ",") {
+		var hop string
+		for _, pair := range strings.Split(elem, ";") {
+			if k, v, _ := strings.Cut(strings.TrimSpace(pair), "="); strings.EqualFold(k, "for") {
+				hop = v
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseHop parses address of a forwarded header element, which may be
+// quoted, and may have a port, i.e. "[2001:db8::1]:4711"
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	return addr, err == nil
+}
+
+// allowNetworks wraps next handler, replying with 403 Forbidden to clients
+// outside of allowed networks, if there are any
+func (h *handler) allowNetworks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nets := h.policy.Load().allowedNets
+		if nets == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if addr := h.clientIP(r); !addr.IsValid() || !nets.contains(addr) {
+			ctxLogger(r.Context()).Info("client address not allowed", "addr", addr)
+			h.error(w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestNetList(t *testing.T) {
+	var l netList
+	if err := l.Set("10.0.0.0/8, 192.0.2.1,2001:db8::/32"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l.String(), "10.0.0.0/8,192.0.2.1/32,2001:db8::/32"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, tc := range []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	} {
+		if got := l.contains(netip.MustParseAddr(tc.addr)); got != tc.want {
+			t.Errorf("contains(%s) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+	if err := l.Set("::ffff:10.0.0.0/104"); err == nil {
+		t.Error("IPv4-mapped network is accepted")
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		hdr  http.Header
+		want []string
+	}{
+		{"x-forwarded-for", http.Header{"X-Forwarded-For": {"192.0.2.1, 198.51.100.1", "203.0.113.1"}},
+			[]string{"192.0.2.1", " 198.51.100.1", "203.0.113.1"}},
+		{"forwarded", http.Header{"Forwarded": {`for=192.0.2.1;proto=https, by=10.0.0.1;For="[2001:db8::1]:4711"`}},
+			[]string{"192.0.2.1", `"[2001:db8::1]:4711"`}},
+		{"forwarded without for", http.Header{"Forwarded": {"proto=https", "for=192.0.2.1"}},
+			[]string{"", "192.0.2.1"}},
+		{"forwarded wins", http.Header{"Forwarded": {"for=192.0.2.1"}, "X-Forwarded-For": {"198.51.100.1"}},
+			[]string{"192.0.2.1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := forwardedFor(tc.hdr); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var proxies netList
+	if err := proxies.Set("10.0.0.0/8,fd00::/8"); err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{}
+	h.policy.Store(&policy{trustedProxies: proxies})
+	for _, tc := range []struct {
+		name   string
+		remote string
+		hdr    http.Header
+		want   string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.1"},
+		{"trusted peer", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"rightmost untrusted", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.1, 10.0.0.2"}},
+			"203.0.113.1"},
+		{"spoofed left entries", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 127.0.0.1", "203.0.113.1"}},
+			"203.0.113.1"},
+		{"forwarded quoted ipv6", "[fd00::1]:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}},
+			"2001:db8::1"},
+		{"forwarded spoofed left entries", "10.0.0.1:1234", http.Header{"Forwarded": {`for=10.0.0.5, for="[2001:db8::2]", for=10.0.0.2`}},
+			"2001:db8::2"},
+		{"forwarded ipv4-mapped", "10.0.0.1:1234", http.Header{"Forwarded": {`for="[::ffff:192.0.2.7]"`}},
+			"192.0.2.7"},
+		{"obfuscated hop", "10.0.0.1:1234", http.Header{"Forwarded": {"for=192.0.2.1, for=_hidden"}},
+			"10.0.0.1"},
+		{"all trusted", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			for k, v := range tc.hdr {
+				r.Header[k] = v
+			}
+			if got := h.clientIP(r).String(); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
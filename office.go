@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// officeTypes maps media types of office documents to file name extensions
+// LibreOffice recognizes them by
+var officeTypes = map[string]string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                            ".ods",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+	"application/msword":            ".doc",
+	"application/vnd.ms-excel":      ".xls",
+	"application/vnd.ms-powerpoint": ".ppt",
+	"application/rtf":               ".rtf",
+}
+
+// serveOffice handles requests with office document bodies, converting them
+// with LibreOffice
+func (h *handler) serveOffice(w http.ResponseWriter, r *http.Request) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	dir, err := os.MkdirTemp("", "pdfsvc-office-")
+	if err != nil {
+		ctxLogger(r.Context()).Error("creating office directory failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "document"+officeTypes[mt])
+	if err := writeFile(name, r.Body); err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	h.serveConverted(w, r, source{file: name, office: true})
+}
+
+// libreOffice renders office documents with LibreOffice. It only supports
+// file sources, and no options modifying html documents.
+type libreOffice struct{ renderConfig }
+
+func (libreOffice) command() string { return "soffice" }
+
+func (lo libreOffice) render(ctx context.Context, src source, opts options, w, stderr io.Writer) (*os.ProcessState, error) {
+	if src.file == "" || opts.stylesheet() != "" || opts.toc || opts.jsDelay > 0 || opts.screenshot {
+		return nil, errUnsupported
+	}
+	dir, err := os.MkdirTemp("", "pdfsvc-soffice-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// separate profile per process allows concurrent conversions
+	cmd := lo.renderCommand(ctx, append(srcBinds(src), dir), "soffice",
+		"--headless",
+		"--norestore",
+		"--nolockcheck",
+		"-env:UserInstallation=file://"+filepath.Join(dir, "profile"),
+		"--convert-to", "pdf",
+		"--outdir", dir,
+		src.file,
+	)
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+	// soffice is a wrapper spawning the actual office process
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		return cmd.ProcessState, err
+	}
+	base := filepath.Base(src.file)
+	f, err := os.Open(filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base))+".pdf"))
+	if err != nil {
+		// soffice exits with zero code even if it failed to convert
+		return cmd.ProcessState, err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return cmd.ProcessState, err
+}
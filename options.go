@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options are per-request conversion settings
+type options struct {
+	priority  priority
+	sink      *url.URL // if set, upload document there instead of replying with it
+	callback  *url.URL // if set, post status of asynchronous job there
+	docID     string   // document id used in filename pattern
+	filename  string   // Content-Disposition file name, overrides the pattern
+	page      page
+	userCSS   string        // stylesheet applied on top of document styles
+	encrypt   *encryption   // if set, protect document with passwords
+	watermark string        // text to stamp over each page
+	meta      metadata      // document information
+	toc       bool          // insert table of contents
+	js        bool          // run scripts in the document, chromium only
+	jsDelay   time.Duration // time to let scripts run before capture
+	warnLevel warnLevel     // renderer messages to report
+	text      textOptions   // plain text input options
+	pageRange string        // pages to keep, i.e. 1-3,7
+	split     []string      // page ranges of /split documents
+	linearize bool          // optimize document for fast web view
+	optimize  bool          // recompress document to reduce its size
+
+	screenshot bool     // capture image instead of PDF, chromium only
+	window     viewport // browser window size of screenshot
+	jpeg       bool     // reply with JPEG image instead of PNG
+	quality    int      // JPEG quality, 1-100, defaultJPEGQuality if 0
+
+	timeout time.Duration // conversion timeout, handler default if 0
+}
+
+// requestOptions extracts conversion options from X-Pdf-* request headers,
+// honoring handler's policy on which of them clients are allowed to set.
+func (h *handler) requestOptions(r *http.Request) (options, error) {
+	p := h.policy.Load()
+	in := r.Header
+	if s := r.URL.Query().Get("filename"); s != "" && in.Get("X-Pdf-Filename") == "" {
+		// filename query parameter is an alias of X-Pdf-Filename header
+		in = in.Clone()
+		in.Set("X-Pdf-Filename", s)
+	}
+	hdr := make(http.Header)
+	for k, v := range in {
+		if k == "X-Priority" {
+			// X-Priority is an alias of X-Pdf-Priority, the latter wins
+			if _, ok := in["X-Pdf-Priority"]; ok {
+				continue
+			}
+			k = "X-Pdf-Priority"
+		}
+		if !strings.HasPrefix(k, optionPrefix) {
+			continue
+		}
+		if p.allowedOptions != nil && !p.allowedOptions[k] {
+			if p.rejectDisallowed {
+				return options{}, fmt.Errorf("option %s is not allowed", k)
+			}
+			continue
+		}
+		hdr[k] = v
+	}
+	opts, err := parseOptions(hdr)
+	if err != nil {
+		return opts, err
+	}
+	if opts.js && !p.allowJS {
+		return opts, errors.New("javascript is not allowed")
+	}
+	if opts.jsDelay > p.maxJSDelay {
+		return opts, errors.New("javascript delay is over the limit")
+	}
+	if hdr.Get("X-Pdf-Linearize") == "" {
+		opts.linearize = p.linearize
+	}
+	if hdr.Get("X-Pdf-Priority") == "" && p.tokenPriority != nil {
+		if prio, ok := p.tokenPriority[h.tokenName(r)]; ok {
+			opts.priority = prio
+		}
+	}
+	return opts, nil
+}
+
+// stylesheet returns CSS that renderer applies on top of document styles:
+// page layout rule followed by user stylesheet, so the latter can override it
+func (opts options) stylesheet() string {
+	css := opts.page.css()
+	if css != "" && opts.userCSS != "" {
+		css += "\n"
+	}
+	return css + opts.userCSS
+}
+
+// optionPrefix is a canonical prefix of headers carrying conversion options
+const optionPrefix = "X-Pdf-"
+
+// parseOptions extracts conversion options from X-Pdf-* headers
+func parseOptions(hdr http.Header) (options, error) {
+	var opts options
+	var err error
+	if opts.priority, err = parsePriority(hdr.Get("X-Pdf-Priority")); err != nil {
+		return opts, err
+	}
+	opts.docID = hdr.Get("X-Pdf-Doc-Id")
+	if s := hdr.Get("X-Pdf-Filename"); s != "" {
+		if opts.filename, err = parseFilename(s); err != nil {
+			return opts, err
+		}
+	}
+	if opts.page, err = parsePage(hdr); err != nil {
+		return opts, err
+	}
+	if opts.userCSS = hdr.Get("X-Pdf-User-Stylesheet"); opts.userCSS != "" {
+		if err := checkUserStyle(opts.userCSS); err != nil {
+			return opts, err
+		}
+	}
+	opts.meta = parseMetadata(hdr)
+	if s := hdr.Get("X-Pdf-Toc"); s != "" {
+		if opts.toc, err = strconv.ParseBool(s); err != nil {
+			return opts, err
+		}
+	}
+	if opts.watermark = hdr.Get("X-Pdf-Watermark"); len(opts.watermark) > maxWatermarkLen {
+		return opts, errors.New("watermark is too long")
+	}
+	if s := hdr.Get("X-Pdf-Linearize"); s != "" {
+		if opts.linearize, err = strconv.ParseBool(s); err != nil {
+			return opts, err
+		}
+	}
+	if s := hdr.Get("X-Pdf-Optimize"); s != "" {
+		if opts.optimize, err = strconv.ParseBool(s); err != nil {
+			return opts, err
+		}
+	}
+	js := hdr.Get("X-Pdf-Javascript")
+	if js != "" {
+		if opts.js, err = strconv.ParseBool(js); err != nil {
+			return opts, err
+		}
+	}
+	if s := hdr.Get("X-Pdf-Javascript-Delay"); s != "" {
+		if opts.jsDelay, err = time.ParseDuration(s); err != nil {
+			return opts, err
+		}
+		if opts.jsDelay < 0 || opts.jsDelay > 0 && js != "" && !opts.js {
+			return opts, fmt.Errorf("invalid javascript delay %q", s)
+		}
+		// delay is only useful with scripts enabled
+		opts.js = opts.js || opts.jsDelay > 0
+	}
+	if opts.window, err = parseViewport(hdr.Get("X-Pdf-Window-Size")); err != nil {
+		return opts, err
+	}
+	if opts.jpeg, opts.quality, err = parseImageFormat(hdr); err != nil {
+		return opts, err
+	}
+	if opts.text, err = parseTextOptions(hdr); err != nil {
+		return opts, err
+	}
+	if opts.warnLevel, err = parseWarnLevel(hdr.Get("X-Pdf-Warning-Level")); err != nil {
+		return opts, err
+	}
+	if opts.pageRange = strings.ReplaceAll(hdr.Get("X-Pdf-Page-Range"), " ", ""); opts.pageRange != "" &&
+		!pageRange.MatchString(opts.pageRange) {
+		return opts, fmt.Errorf("invalid page range %q", opts.pageRange)
+	}
+	if s := strings.ReplaceAll(hdr.Get("X-Pdf-Split"), " ", ""); s != "" {
+		if !pageRange.MatchString(s) {
+			return opts, fmt.Errorf("invalid split ranges %q", s)
+		}
+		opts.split = strings.Split(s, ",")
+		seen := make(map[string]bool, len(opts.split))
+		for _, v := range opts.split {
+			if seen[v] {
+				return opts, fmt.Errorf("duplicate split range %q", v)
+			}
+			seen[v] = true
+		}
+	}
+	if opts.encrypt, err = parseEncryption(hdr); err != nil {
+		return opts, err
+	}
+	if s := hdr.Get("X-Pdf-Sink"); s != "" {
+		if opts.sink, err = parseHTTPURL(s); err != nil {
+			return opts, err
+		}
+	}
+	if s := hdr.Get("X-Pdf-Callback"); s != "" {
+		if opts.callback, err = parseHTTPURL(s); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
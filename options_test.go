@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		hdr      map[string]string
+		allowed  []string // -allowed-options
+		strict   bool     // -reject-disallowed
+		size     string
+		priority priority
+		wantErr  bool
+	}{
+		{name: "all allowed",
+			hdr:  map[string]string{"X-Pdf-Page-Size": "a5", "X-Pdf-Priority": "high"},
+			size: "A5", priority: priorityHigh},
+		{name: "disallowed dropped",
+			hdr:     map[string]string{"X-Pdf-Page-Size": "a5", "X-Pdf-Priority": "high"},
+			allowed: []string{"X-Pdf-Priority"}, priority: priorityHigh},
+		{name: "allowed option names are case insensitive",
+			hdr:     map[string]string{"X-Pdf-Page-Size": "a5"},
+			allowed: []string{"x-pdf-page-size"}, size: "A5"},
+		{name: "invalid disallowed value ignored",
+			hdr:     map[string]string{"X-Pdf-Page-Size": "bogus"},
+			allowed: []string{"X-Pdf-Priority"}},
+		{name: "invalid allowed value rejected",
+			hdr:     map[string]string{"X-Pdf-Page-Size": "bogus"},
+			wantErr: true},
+		{name: "disallowed rejected",
+			hdr:     map[string]string{"X-Pdf-Page-Size": "a5"},
+			allowed: []string{"X-Pdf-Priority"}, strict: true, wantErr: true},
+		{name: "strict with allowed only",
+			hdr:     map[string]string{"X-Pdf-Priority": "low"},
+			allowed: []string{"X-Pdf-Priority"}, strict: true, priority: priorityLow},
+		{name: "other headers ignored",
+			hdr:     map[string]string{"Accept": "application/pdf"},
+			allowed: []string{"X-Pdf-Priority"}, strict: true},
+		{name: "priority alias",
+			hdr:      map[string]string{"X-Priority": "low"},
+			priority: priorityLow},
+		{name: "priority alias loses",
+			hdr:      map[string]string{"X-Priority": "low", "X-Pdf-Priority": "high"},
+			priority: priorityHigh},
+		{name: "priority alias loses to empty",
+			hdr:      map[string]string{"X-Priority": "low", "X-Pdf-Priority": ""},
+			priority: priorityNormal},
+		{name: "priority alias filtered as X-Pdf-Priority",
+			hdr:     map[string]string{"X-Priority": "low"},
+			allowed: []string{"X-Pdf-Page-Size"}, strict: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, "", func(args *cmdArgs) {
+				args.Options, args.Strict = strings.Join(tc.allowed, ","), tc.strict
+			})
+			r := httptest.NewRequest("POST", "/", nil)
+			for k, v := range tc.hdr {
+				r.Header.Set(k, v)
+			}
+			opts, err := h.requestOptions(r)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.page.size != tc.size {
+				t.Errorf("got page size %q, want %q", opts.page.size, tc.size)
+			}
+			if opts.priority != tc.priority {
+				t.Errorf("got priority %v, want %v", opts.priority, tc.priority)
+			}
+		})
+	}
+}
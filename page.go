@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// pageSizes maps lowercase names of page sizes allowed in X-Pdf-Page-Size
+// header to their CSS names
+var pageSizes = map[string]string{
+	"a3":     "A3",
+	"a4":     "A4",
+	"a5":     "A5",
+	"b4":     "B4",
+	"b5":     "B5",
+	"letter": "letter",
+	"legal":  "legal",
+	"ledger": "ledger",
+}
+
+// cssLength matches lengths allowed in X-Pdf-Margin-* headers
+var cssLength = regexp.MustCompile(`^(0|[0-9]{1,4}(\.[0-9]{1,3})?(mm|cm|in|pt|px))$`)
+
+// page holds page layout options
+type page struct {
+	size        string // CSS page size name
+	orientation string // portrait or landscape
+	margins     [4]string
+}
+
+// marginSides are names of page sides in the order of page.margins
+var marginSides = [...]string{"Top", "Right", "Bottom", "Left"}
+
+// parsePage validates page layout options from X-Pdf-Page-Size,
+// X-Pdf-Orientation and X-Pdf-Margin-{Top,Right,Bottom,Left} headers.
+func parsePage(hdr http.Header) (page, error) {
+	var p page
+	if s := hdr.Get("X-Pdf-Page-Size"); s != "" {
+		var ok bool
+		if p.size, ok = pageSizes[strings.ToLower(s)]; !ok {
+			return p, fmt.Errorf("unsupported page size %q", s)
+		}
+	}
+	switch s := strings.ToLower(hdr.Get("X-Pdf-Orientation")); s {
+	case "", "portrait", "landscape":
+		p.orientation = s
+	default:
+		return p, fmt.Errorf("unsupported page orientation %q", s)
+	}
+	for i, side := range marginSides {
+		s := hdr.Get("X-Pdf-Margin-" + side)
+		if s != "" && !cssLength.MatchString(s) {
+			return p, fmt.Errorf("invalid %s margin %q", strings.ToLower(side), s)
+		}
+		p.margins[i] = s
+	}
+	return p, nil
+}
+
+// css returns CSS @page rule applying layout options, or an empty string if
+// no options are set.
+func (p page) css() string {
+	var decls []string
+	switch {
+	case p.size != "" && p.orientation != "":
+		decls = append(decls, "size: "+p.size+" "+p.orientation)
+	case p.size != "":
+		decls = append(decls, "size: "+p.size)
+	case p.orientation != "":
+		decls = append(decls, "size: "+p.orientation)
+	}
+	for i, m := range p.margins {
+		if m != "" {
+			decls = append(decls, "margin-"+strings.ToLower(marginSides[i])+": "+m)
+		}
+	}
+	if len(decls) == 0 {
+		return ""
+	}
+	return "@page { " + strings.Join(decls, "; ") + " }"
+}
+
+// maxUserStyleLen is max length of user stylesheet
+const maxUserStyleLen = 64 << 10
+
+// checkUserStyle rejects user stylesheets that are too long or could close
+// <style> element they're injected into by some renderers
+func checkUserStyle(css string) error {
+	if len(css) > maxUserStyleLen {
+		return errors.New("user stylesheet is too long")
+	}
+	if strings.Contains(css, "</") {
+		return errors.New("user stylesheet must not contain \"</\"")
+	}
+	return nil
+}
+
+// injectStyle parses html document from r and returns it with a <style>
+// element holding css appended to its head.
+func injectStyle(r io.Reader, css string) (io.Reader, error) {
+	return rewriteHead(r, func(head *html.Node) { appendStyle(head, css) })
+}
+
+// injectStyleFile is like injectStyle, but modifies html document file in
+// place.
+func injectStyleFile(name, css string) error {
+	return rewriteHeadFile(name, func(head *html.Node) { appendStyle(head, css) })
+}
+
+func appendStyle(head *html.Node, css string) {
+	style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style}
+	style.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+	head.AppendChild(style)
+}
+
+// utf8Document parses utf-8 encoded html document from r and returns it with
+// its charset declarations replaced by <meta charset="utf-8">. If css is not
+// empty, it's injected as with injectStyle.
+func utf8Document(r io.Reader, css string) (io.Reader, error) {
+	return rewriteHead(r, func(head *html.Node) {
+		for n := head.FirstChild; n != nil; {
+			next := n.NextSibling
+			if declaresCharset(n) {
+				head.RemoveChild(n)
+			}
+			n = next
+		}
+		head.InsertBefore(&html.Node{Type: html.ElementNode, Data: "meta", DataAtom: atom.Meta,
+			Attr: []html.Attribute{{Key: "charset", Val: "utf-8"}}}, head.FirstChild)
+		if css != "" {
+			appendStyle(head, css)
+		}
+	})
+}
+
+// declaresCharset reports whether n is either <meta charset> or
+// <meta http-equiv="content-type"> element
+func declaresCharset(n *html.Node) bool {
+	if n.Type != html.ElementNode || n.DataAtom != atom.Meta {
+		return false
+	}
+	for _, a := range n.Attr {
+		if a.Key == "charset" || a.Key == "http-equiv" && strings.EqualFold(a.Val, "content-type") {
+			return true
+		}
+	}
+	return false
+}
+
+func setAttr(n *html.Node, key, val string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+// rewriteHead parses html document from r, calls fn on its head element and
+// returns the modified document.
+func rewriteHead(r io.Reader, fn func(head *html.Node)) (io.Reader, error) {
+	return rewriteDoc(r, headFunc(fn))
+}
+
+// rewriteHeadFile is like rewriteHead, but modifies html document file in
+// place.
+func rewriteHeadFile(name string, fn func(head *html.Node)) error {
+	return rewriteDocFile(name, headFunc(fn))
+}
+
+func headFunc(fn func(head *html.Node)) func(doc *html.Node) error {
+	return func(doc *html.Node) error {
+		head := findElement(doc, atom.Head)
+		if head == nil {
+			return errors.New("document has no head")
+		}
+		fn(head)
+		return nil
+	}
+}
+
+// rewriteDoc parses html document from r, calls fn on its root node and
+// returns the modified document.
+func rewriteDoc(r io.Reader, fn func(doc *html.Node) error) (io.Reader, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(doc); err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := html.Render(buf, doc); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// rewriteDocFile is like rewriteDoc, but modifies html document file in
+// place.
+func rewriteDocFile(name string, fn func(doc *html.Node) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := rewriteDoc(f, fn)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return writeFile(name, r)
+}
+
+// findElement returns first element of a given type in a depth-first order
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -3,137 +3,1329 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/html/charset"
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/artyom/autoflags"
 	"github.com/artyom/buffering"
+	"github.com/artyom/bytesize"
 	"github.com/artyom/exitstatus"
 )
 
-func main() {
+// cmdArgs are command line flags, see defaultArgs for their defaults
+type cmdArgs struct {
+	Config   string        `flag:"config,file with flag values as flat TOML key = value lines, overridden by command line flags and PDFSVC_* environment variables"`
+	Addr     string        `flag:"addr,address to listen, or unix:/path/to.sock; ignored if started with systemd socket activation"`
+	Admin    string        `flag:"admin-addr,address (or unix:/path/to.sock) to serve metrics and operational endpoints at, disabled if empty"`
+	Engine   string        `flag:"engine,rendering engine: weasyprint or chromium"`
+	RndPath  string        `flag:"renderer-path,path to renderer executable, i.e. a patched build; engine command from PATH if empty"`
+	RndArgs  string        `flag:"renderer-args,space-separated extra arguments to run renderer with, i.e. --dpi 300"`
+	Timeout  time.Duration `flag:"d,max time to allow wkhtmltopdf command to run"`
+	Procs    int           `flag:"n,max number of concurrent processes to allow"`
+	MinProcs int           `flag:"n-min,if set below -n, adjust number of concurrent processes between this and -n based on memory pressure and conversion time"`
+	NLatency time.Duration `flag:"n-latency,with -n-min, reduce number of concurrent processes while average conversion takes longer than this"`
+	PerKey   int           `flag:"token-concurrency,max number of concurrent requests per token (or client IP), unlimited if 0"`
+	PerKB    time.Duration `flag:"timeout-per-kb,increase -d timeout by this much for every KiB of input"`
+	MaxD     time.Duration `flag:"max-timeout,upper bound of timeout increased with -timeout-per-kb, unlimited if 0"`
+	Aging    time.Duration `flag:"priority-aging,queue advantage of each X-Pdf-Priority level over the one below"`
+	TokPrio  string        `flag:"token-priority,comma-separated name:priority pairs setting default priority of tokens from -token-file, i.e. nightly:low"`
+	Token    string        `flag:"token,if set, check Authorization Bearer token"`
+	Tokens   string        `flag:"token-file,file with accepted Bearer tokens, one token or token=name per line"`
+	Hashes   string        `flag:"token-hash-file,file with salted hashes of accepted Bearer tokens, one per line"`
+	JWTKey   string        `flag:"jwt-secret,accept Bearer tokens that are JWTs signed with this HS256 secret, defaults to JWT_SECRET env"`
+	JWKS     string        `flag:"jwks-url,accept Bearer tokens that are JWTs signed (RS256 or ES256) with keys from this JSON Web Key Set url"`
+	JWTIss   string        `flag:"jwt-issuer,required iss claim of JWT Bearer tokens"`
+	JWTAud   string        `flag:"jwt-audience,required aud claim of JWT Bearer tokens"`
+	JWTScope string        `flag:"jwt-scopes,comma-separated scopes JWT Bearer tokens must have"`
+	SignKey  string        `flag:"signing-secret,accept requests signed with this secret in X-Signature header, defaults to SIGNING_SECRET env"`
+	Quiet    bool          `flag:"q,be quiet, log less"`
+	MaxHdr   int           `flag:"max-header-bytes,max size of request headers, Go default (1MiB) if 0"`
+	MaxBody  byteSize      `flag:"max-body-size,max size of request body, i.e. 10MiB"`
+	BufDir   string        `flag:"buffer-dir,directory to buffer large request bodies in, system temporary directory if empty"`
+	MemBuf   byteSize      `flag:"mem-buffer-size,buffer request bodies up to this size in memory instead of files"`
+	Cache    byteSize      `flag:"cache-size,max total size of cached documents, caching is disabled if 0"`
+	CacheDir string        `flag:"cache-dir,directory to keep cached documents in, temporary one if empty"`
+	NoKA     bool          `flag:"no-keepalive,disable HTTP keep-alives"`
+	Compress bool          `flag:"compress,gzip PDF, JSON and text replies for clients accepting it"`
+	CmpMin   byteSize      `flag:"compress-min-size,don't compress replies smaller than this"`
+	Errors   string        `flag:"error-format,format of error responses: text, json or problem"`
+	LogFmt   string        `flag:"log-format,format of log messages: text or json"`
+	AccLog   string        `flag:"access-log,file to write a line per request to, or - for stdout; disabled if empty"`
+	AccFmt   string        `flag:"access-log-format,format of access log lines: common or json"`
+	AccSize  byteSize      `flag:"access-log-max-size,rotate access log file once it grows over this size, never if 0"`
+	AccKeep  int           `flag:"access-log-backups,number of rotated access log files to keep"`
+	Options  string        `flag:"allowed-options,comma-separated X-Pdf-* request headers to honor, all if empty"`
+	Strict   bool          `flag:"reject-disallowed,reject requests with X-Pdf-* headers not in -allowed-options"`
+	Sink     bool          `flag:"allow-sink,allow uploading documents to X-Pdf-Sink urls"`
+	Sinks    string        `flag:"sink-hosts,comma-separated hosts allowed in X-Pdf-Sink urls, any if empty"`
+	Headers  headerList    `flag:"response-header,header to add to successful replies, in Name: Value form; can be repeated"`
+	Fname    string        `flag:"filename,filename pattern for Content-Disposition header, i.e. invoice-{id}-{date}.pdf"`
+	URLHosts string        `flag:"url-hosts,comma-separated hosts allowed for conversion at /url, endpoint is disabled if empty"`
+	ResHosts string        `flag:"resource-hosts,comma-separated hosts renderer may fetch external resources from, through a built-in filtering proxy; unrestricted if empty"`
+	URLTime  time.Duration `flag:"url-timeout,max time to allow conversion of a document at /url to run"`
+	JobsDir  string        `flag:"jobs-dir,directory to keep results of /jobs conversions in, keep in memory if empty"`
+	JobsTTL  time.Duration `flag:"job-retention,how long to keep results of finished /jobs conversions"`
+	MaxJobs  int           `flag:"max-jobs,max number of unfinished /jobs conversions, unlimited if 0"`
+	JobsSize byteSize      `flag:"max-job-results-size,max total size of kept /jobs results, unlimited if 0"`
+	CBHosts  string        `flag:"callback-hosts,comma-separated hosts allowed in X-Pdf-Callback urls of /jobs, callbacks are disabled if empty"`
+	CBSecret string        `flag:"callback-secret,secret to sign X-Pdf-Callback payloads with, defaults to CALLBACK_SECRET env"`
+	Tmpls    string        `flag:"templates-dir,directory with *.html.tmpl templates to serve at /render/{name}"`
+	TmplAPI  bool          `flag:"manage-templates,allow uploading and deleting templates at /templates/{name}"`
+	FontsDir string        `flag:"fonts-dir,directory with extra fonts for renderers, font families are listed at /fonts"`
+	FontAPI  bool          `flag:"manage-fonts,allow uploading and deleting fonts at /fonts/{name} of -admin-addr"`
+	AllowJS  bool          `flag:"allow-javascript,let clients enable scripts in documents with X-Pdf-Javascript: true, chromium only"`
+	JSDelay  time.Duration `flag:"max-js-delay,max X-Pdf-Javascript-Delay clients may request to let scripts finish before capture, chromium only"`
+	Sandbox  bool          `flag:"sandbox,run renderer with bubblewrap, isolated from network and other requests' temporary files, with read-only filesystem"`
+	SBNet    bool          `flag:"sandbox-network,allow network access in -sandbox, implied by -resource-hosts, and by -url-hosts for /url"`
+	MaxMem   byteSize      `flag:"renderer-memory,max data segment size of renderer process, i.e. 1GiB, unlimited if 0"`
+	MaxCPU   time.Duration `flag:"renderer-cpu,max CPU time of renderer process, unlimited if 0"`
+	MaxOut   byteSize      `flag:"max-output-size,max size of a converted document, i.e. 50MiB, unlimited if 0"`
+	Office   bool          `flag:"office,convert office documents (docx, xlsx, odt and others) with LibreOffice"`
+	Linear   bool          `flag:"linearize,linearize documents for fast web view, unless request sets X-Pdf-Linearize: false"`
+	Lenient  bool          `flag:"tolerate-warnings,serve output of a failed conversion if it looks like a valid PDF"`
+	TLSCert  string        `flag:"tls-cert,TLS certificate file, serve plain HTTP if empty"`
+	TLSKey   string        `flag:"tls-key,TLS private key file"`
+	H2C      bool          `flag:"h2c,accept HTTP/2 without TLS (prior knowledge) on plain HTTP listener"`
+	AllowNet netList       `flag:"allow-cidr,network allowed to use the service, i.e. 10.0.0.0/8; can be repeated, any if not set"`
+	Proxies  netList       `flag:"trusted-proxies,comma-separated addresses or networks of reverse proxies whose X-Forwarded-For header is trusted"`
+	Rate     float64       `flag:"token-rate,max requests per second per token (or client IP), unlimited if 0"`
+	Burst    int           `flag:"token-burst,max number of requests made at once within -token-rate limit"`
+	Quota    byteSize      `flag:"token-daily-bytes,max bytes of documents produced per token (or client IP) per UTC day, unlimited if 0"`
+	PageQ    int           `flag:"token-daily-pages,max pages of documents produced per token (or client IP) per UTC day, unlimited if 0"`
+	MaxQueue int           `flag:"max-queue,max number of requests waiting for a conversion slot, others get 503 at once; unlimited if 0"`
+	MaxWait  time.Duration `flag:"max-queue-wait,max time request may wait for a conversion slot before it gets 503, unlimited if 0"`
+	Retry    bool          `flag:"retry-crashed,run renderer once more if it's killed by a signal, i.e. crashes with segmentation fault"`
+	BrkFails int           `flag:"breaker-failures,after this many renderer failures in a row, fail conversions with 503 at once and report not ready; disabled if 0"`
+	BrkWait  time.Duration `flag:"breaker-cooldown,time to fail conversions for after -breaker-failures, before letting one through to check the renderer"`
+	Saturate time.Duration `flag:"ready-saturation,report not ready at /readyz if all -n slots are busy for this long, never if 0"`
+	Grace    time.Duration `flag:"grace,on SIGTERM or SIGINT, max time to wait for in-flight conversions to finish"`
+
+	SelfTest  selfTestMode `flag:"selftest,convert a test document on startup; if it fails, refuse to start with -selftest or -selftest=strict, only log the failure with -selftest=warn"`
+	HashToken bool         `flag:"hash-token,read token from stdin, print its hash for -token-hash-file and exit"`
+}
+
+// defaultArgs returns command line flags with default values, some of which
+// are taken from environment variables
+func defaultArgs() *cmdArgs {
 	defaultAddr := os.Getenv("ADDR")
 	if defaultAddr == "" {
 		defaultAddr = "localhost:8080"
 	}
-	args := &struct {
-		Addr    string        `flag:"addr,address to listen"`
-		Timeout time.Duration `flag:"d,max time to allow wkhtmltopdf command to run"`
-		Procs   int           `flag:"n,max number of concurrent processes to allow"`
-		Token   string        `flag:"token,if set, check Authorization Bearer token"`
-		Quiet   bool          `flag:"q,be quiet, log less"`
-	}{
-		Addr:    defaultAddr,
-		Timeout: 5 * time.Second,
-		Procs:   3,
-		Token:   os.Getenv("TOKEN"),
+	return &cmdArgs{
+		Addr:     defaultAddr,
+		Engine:   "weasyprint",
+		Grace:    30 * time.Second,
+		Saturate: 30 * time.Second,
+		BrkWait:  30 * time.Second,
+		Timeout:  5 * time.Second,
+		Procs:    3,
+		NLatency: 3 * time.Second,
+		Aging:    10 * time.Second,
+		URLTime:  15 * time.Second,
+		JobsTTL:  time.Hour,
+		MaxJobs:  100,
+		JobsSize: 256 << 20,
+		Token:    os.Getenv("TOKEN"),
+		CBSecret: os.Getenv("CALLBACK_SECRET"),
+		JWTKey:   os.Getenv("JWT_SECRET"),
+		SignKey:  os.Getenv("SIGNING_SECRET"),
+		Errors:   "text",
+		LogFmt:   "text",
+		AccFmt:   "common",
+		AccSize:  100 << 20,
+		AccKeep:  3,
+		CmpMin:   1 << 10,
+		MaxBody:  1 << 20,
+		MemBuf:   buffering.DefaultBufSize,
 	}
+}
+
+func main() {
+	args := defaultArgs()
 	autoflags.Parse(args)
+	if err := applyConfig(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if args.HashToken {
+		sc := bufio.NewScanner(os.Stdin)
+		if !sc.Scan() || sc.Text() == "" {
+			log.Fatal("no token read from stdin")
+		}
+		line, err := newTokenHash(sc.Text())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(line)
+		return
+	}
 	if args.Procs <= 0 {
 		args.Procs = 1
 	}
-	h := &handler{gate: make(chan struct{}, args.Procs),
-		d: args.Timeout, token: args.Token, noisy: !args.Quiet}
+	if args.Errors != "text" && args.Errors != "json" && args.Errors != "problem" {
+		log.Fatal("unsupported -error-format value: ", args.Errors)
+	}
+	if !setLogFormat(args.LogFmt) {
+		log.Fatal("unsupported -log-format value: ", args.LogFmt)
+	}
+	h := &handler{gate: newGate(args.Procs, args.Aging),
+		errorFormat: args.Errors, saturation: args.Saturate, maxBody: int64(args.MaxBody)}
+	h.gate.setQueueLimits(args.MaxQueue, args.MaxWait)
+	p, err := newPolicy(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.policy.Store(p)
+	h.flags = flagValues(flag.CommandLine)
+	if args.MinProcs > 0 && args.MinProcs < args.Procs {
+		h.gate.resize(args.MinProcs)
+		h.tuner = &tuner{g: h.gate, min: args.MinProcs, max: args.Procs, latency: args.NLatency}
+		go h.tuner.run(5 * time.Second)
+	}
+	h.noisy.Store(!args.Quiet)
+	var proxy, urlProxy string
+	if hosts := commaSet(args.ResHosts, strings.ToLower); hosts != nil {
+		// documents at /url are fetched through the proxy too
+		for host := range commaSet(args.URLHosts, strings.ToLower) {
+			hosts[host] = true
+		}
+		if proxy, err = startResourceProxy(hosts); err != nil {
+			log.Fatal(err)
+		}
+		urlProxy = proxy
+	} else if hosts := commaSet(args.URLHosts, strings.ToLower); hosts != nil {
+		// documents at /url could redirect renderer to any host, so they're
+		// always fetched through the proxy, along with their resources
+		if urlProxy, err = startResourceProxy(hosts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var sb *sandbox
+	if args.Sandbox {
+		if _, err := exec.LookPath("bwrap"); err != nil {
+			log.Fatal("-sandbox requires bubblewrap: ", err)
+		}
+		// resource proxy listens on the host network
+		sb = &sandbox{network: args.SBNet || proxy != ""}
+		if filepath.IsAbs(args.RndPath) {
+			sb.readOnly = append(sb.readOnly, filepath.Dir(args.RndPath))
+		}
+		h.isolated = true
+	}
+	if args.Engine == "chromium" && sb == nil {
+		// chromium runs scripts of untrusted documents and has to disable
+		// its own sandbox to run in containers, bwrap isolates it instead
+		log.Fatal("-engine=chromium requires -sandbox")
+	}
+	limits := procLimits{memory: uint64(args.MaxMem), cpu: args.MaxCPU, output: uint64(args.MaxOut)}
+	if !limits.empty() {
+		if _, err := exec.LookPath("prlimit"); err != nil {
+			log.Fatal("renderer limits require prlimit: ", err)
+		}
+	}
+	h.rlimits = limits
+	rcfg := renderConfig{proxy: proxy, sandbox: sb, limits: limits}
+	// office documents are converted by a different command
+	hcfg := rcfg
+	hcfg.path, hcfg.extraArgs = args.RndPath, strings.Fields(args.RndArgs)
+	if h.renderer, err = newRenderer(args.Engine, hcfg); err != nil {
+		log.Fatal(err)
+	}
+	h.engineID = strings.Join(append([]string{h.renderer.command()}, hcfg.extraArgs...), " ")
+	if urlProxy != proxy {
+		// sandbox of the main renderer may have no network with only
+		// -url-hosts set
+		if h.urlRend, err = newRenderer(args.Engine, hcfg.withProxy(urlProxy)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if args.Office {
+		h.office = libreOffice{rcfg}
+	}
+	h.retryCrashed = args.Retry
+	expvar.Publish("renderer_retries", expvar.Func(func() any { return h.retries.Load() }))
+	if args.BrkFails > 0 {
+		h.breakerCooldown = args.BrkWait
+		h.breaker = &breaker{name: h.renderer.command(), threshold: args.BrkFails, cooldown: args.BrkWait}
+		if h.office != nil {
+			h.officeBreaker = &breaker{name: h.office.command(), threshold: args.BrkFails, cooldown: args.BrkWait}
+		}
+		expvar.Publish("breaker_open", expvar.Func(func() any { return h.breaker.isOpen() }))
+	}
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		for range sigs {
+			noisy := !h.noisy.Load()
+			h.noisy.Store(noisy)
+			slog.Info("verbose logging toggled", "enabled", noisy)
+		}
+	}()
+	if args.JWTKey != "" || args.JWKS != "" {
+		h.jwt = &jwtVerifier{issuer: args.JWTIss, audience: args.JWTAud, scopes: commaSet(args.JWTScope, nil)}
+		if args.JWTKey != "" {
+			h.jwt.secret = []byte(args.JWTKey)
+		}
+		if args.JWKS != "" {
+			if h.jwt.keys, err = newKeySet(args.JWKS); err != nil {
+				log.Fatal("-jwks-url: ", err)
+			}
+			go h.jwt.keys.run(time.Hour, func(err error) { slog.Error("JWKS refresh failed", "error", err) })
+		}
+	}
+	if args.SignKey != "" {
+		h.signer = newRequestSigner(args.SignKey)
+	}
+	if args.Tokens != "" {
+		if h.tokens, err = loadTokenFile(args.Tokens); err != nil {
+			log.Fatal(err)
+		}
+		reload := func() {
+			if err := h.tokens.reload(); err != nil {
+				slog.Error("tokens reload failed", "error", err)
+				return
+			}
+			slog.Info("tokens reloaded")
+		}
+		go watchFiles(10*time.Second, reload, args.Tokens)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	if args.Cache > 0 {
+		dir := args.CacheDir
+		if dir == "" {
+			if dir, err = os.MkdirTemp("", "pdfsvc-cache-"); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if h.cache, err = newResultCache(dir, int64(args.Cache)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	h.jobs = newJobStore(args.JobsDir, args.JobsTTL, args.MaxJobs, int64(args.JobsSize))
+	h.callbackSecret = args.CBSecret
+	mux.HandleFunc("/jobs", h.serveJobs)
+	mux.HandleFunc("/jobs/", h.serveJob)
+	mux.HandleFunc("/merge", h.serveMerge)
+	mux.HandleFunc("/batch", h.serveBatch)
+	mux.HandleFunc("/split", h.serveSplit)
+	mux.HandleFunc("/validate", h.serveValidate)
+	mux.HandleFunc("/image", h.serveScreenshot)
+	var root http.Handler = mux
+	if args.Tmpls != "" {
+		if h.templates, err = loadTemplates(args.Tmpls); err != nil {
+			log.Fatal(err)
+		}
+		mux.HandleFunc("/render/", h.serveRender)
+		if args.TmplAPI {
+			mux.HandleFunc("/templates/", h.serveTemplates)
+		}
+	}
+	if args.FontsDir != "" {
+		if h.fonts, err = loadFonts(args.FontsDir); err != nil {
+			log.Fatal(err)
+		}
+		if sb != nil {
+			// fontconfig configuration is written to temporary directory
+			sb.readOnly = append(sb.readOnly, os.Getenv("FONTCONFIG_FILE"), h.fonts.dir)
+		}
+		mux.HandleFunc("/fonts", h.serveFonts)
+		if args.FontAPI && args.Admin == "" {
+			log.Fatal("-manage-fonts requires -admin-addr")
+		}
+		h.fontAPI = args.FontAPI
+		// fonts may also be changed by adding files to the directory
+		go watchFiles(10*time.Second, func() {
+			if err := h.fonts.refresh(); err != nil {
+				slog.Error("fonts refresh failed", "error", err)
+			}
+		}, args.FontsDir)
+	}
+	if h.urlHosts = commaSet(args.URLHosts, strings.ToLower); h.urlHosts != nil {
+		mux.HandleFunc("/url", h.serveURL)
+	}
+	if args.PerKey > 0 {
+		h.inflight = newConcurrencyLimiter(args.PerKey)
+		expvar.Publish("inflight", expvar.Func(func() any { return h.inflight.usage() }))
+		root = h.inflight.limit(h, root)
+	}
+	if args.Rate > 0 || args.Quota > 0 || args.PageQ > 0 {
+		h.limiter = newRateLimiter(args.Rate, args.Burst, int64(args.Quota), int64(args.PageQ))
+		root = h.limiter.limit(h, root)
+	}
+	if h.tokens != nil {
+		h.slots = newTokenSlots(args.Aging)
+		expvar.Publish("token_slots", expvar.Func(func() any { return h.slots.usage() }))
+		root = h.withTokenSlots(root)
+	}
+	root = h.allowNetworks(root)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP)
+		for range sigs {
+			if err := h.reload(); err != nil {
+				slog.Error("reload failed", "error", err)
+				continue
+			}
+			slog.Info("configuration reloaded")
+		}
+	}()
+	// probes are exempt from limits
+	outer := http.NewServeMux()
+	outer.Handle("/", root)
+	outer.HandleFunc("/healthz", h.serveHealth)
+	outer.HandleFunc("/readyz", h.serveReady)
+	root = outer
+	if args.Compress {
+		root = (&compressor{minSize: int(args.CmpMin)}).wrap(root)
+	}
+	root = h.withRequestID(root)
+	if args.AccLog != "" {
+		l, err := newAccessLogger(args.AccLog, args.AccFmt, int64(args.AccSize), args.AccKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		root = l.wrap(h, root)
+	}
+	if args.SelfTest != "" {
+		switch err := h.selfTest(); {
+		case err == nil:
+			slog.Info("self-test passed")
+		case args.SelfTest == selfTestWarn:
+			slog.Error("self-test failed, serving requests anyway", "error", err)
+		default:
+			log.Fatal("self-test failed: ", err)
+		}
+	}
+	expvar.Publish("queue", expvar.Func(func() any { return h.gate.queueDepths() }))
+	expvar.Publish("concurrency", expvar.Func(func() any { return h.gate.limit() }))
+	expvar.Publish("shed", expvar.Func(func() any { return h.gate.shedCounts() }))
+	h.publishRuntimeVars(args.BufDir, args.CacheDir, args.JobsDir)
+	if args.Admin != "" {
+		ln, err := listen(args.Admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			srv := &http.Server{Handler: h.adminHandler(), ReadHeaderTimeout: time.Second}
+			log.Fatal(srv.Serve(ln))
+		}()
+	}
 	srv := &http.Server{
-		Addr:              args.Addr,
-		Handler:           buffering.Handler(h, buffering.WithMaxSize(1<<20)),
+		Handler: buffering.Handler(root,
+			buffering.WithMaxSize(int64(args.MaxBody)),
+			buffering.WithDir(args.BufDir),
+			buffering.WithBufSize(int(args.MemBuf)),
+		),
 		ReadHeaderTimeout: time.Second,
 		ReadTimeout:       time.Minute,
 		WriteTimeout:      time.Minute,
+		MaxHeaderBytes:    args.MaxHdr,
+	}
+	if args.NoKA {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	if (args.TLSCert == "") != (args.TLSKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	if args.TLSCert != "" {
+		cr, err := newCertReloader(args.TLSCert, args.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go cr.watch(10 * time.Second)
+		srv.TLSConfig = &tls.Config{GetCertificate: cr.getCertificate}
+	}
+	// HTTP/2 is always negotiated over TLS; h2c lets gateways multiplex
+	// requests over a single plain text connection too
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	if args.H2C {
+		if args.TLSCert != "" {
+			log.Fatal("-h2c cannot be used with -tls-cert")
+		}
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	ln, err := activationListener()
+	if err != nil {
+		log.Fatal(err)
 	}
-	log.Fatal(srv.ListenAndServe())
+	if ln == nil {
+		if ln, err = listen(args.Addr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigs
+		slog.Info("shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), args.Grace)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("shutdown failed", "error", err)
+			return
+		}
+		// asynchronous jobs may still be running or queued
+		if err := h.gate.drain(ctx); err != nil {
+			slog.Error("conversions did not finish", "error", err)
+		}
+	}()
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// headerList is a flag.Value collecting headers given in "Name: Value" form
+type headerList http.Header
+
+func (l *headerList) String() string {
+	if l == nil || *l == nil {
+		return ""
+	}
+	var b strings.Builder
+	http.Header(*l).Write(&b)
+	return strings.TrimSpace(b.String())
+}
+
+func (l *headerList) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+		return fmt.Errorf("invalid header %q, want Name: Value", s)
+	}
+	if *l == nil {
+		*l = make(headerList)
+	}
+	http.Header(*l).Add(name, value)
+	return nil
+}
+
+// selfTestMode is a flag.Value telling what to do if self-test fails: refuse
+// to start with selfTestStrict, only log the failure with selfTestWarn. Flag
+// given without a value means selfTestStrict.
+type selfTestMode string
+
+const (
+	selfTestStrict selfTestMode = "strict"
+	selfTestWarn   selfTestMode = "warn"
+)
+
+func (m *selfTestMode) String() string {
+	if m == nil {
+		return ""
+	}
+	return string(*m)
+}
+
+func (m *selfTestMode) Set(s string) error {
+	switch s {
+	case "true", string(selfTestStrict):
+		*m = selfTestStrict
+	case "false", "":
+		*m = ""
+	case string(selfTestWarn):
+		*m = selfTestWarn
+	default:
+		return fmt.Errorf("invalid self-test mode %q, want strict or warn", s)
+	}
+	return nil
+}
+
+// IsBoolFlag allows -selftest flag without a value
+func (m *selfTestMode) IsBoolFlag() bool { return true }
+
+// byteSize is a flag.Value holding number of bytes, given either as a plain
+// number, or with one of B, KiB, MiB, GiB suffixes, i.e. "10MiB"
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if b == nil {
+		return ""
+	}
+	return bytesize.Bytes(*b).String()
+}
+
+func (b *byteSize) Set(s string) error {
+	num, unit := s, bytesize.B
+	for _, u := range [...]struct {
+		suffix string
+		size   bytesize.Bytes
+	}{{"KiB", bytesize.KiB}, {"MiB", bytesize.MiB}, {"GiB", bytesize.GiB}, {"B", bytesize.B}} {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			num, unit = v, u.size
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || f < 0 || f*float64(unit) > math.MaxInt64 {
+		return fmt.Errorf("invalid size %q, want a number with optional B, KiB, MiB or GiB suffix", s)
+	}
+	*b = byteSize(f * float64(unit))
+	return nil
+}
+
+// commaSet returns a set of non-empty comma-separated values from s, or nil if
+// there are none. If fn is not nil, values are transformed with it.
+func commaSet(s string, fn func(string) string) map[string]bool {
+	var set map[string]bool
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if fn != nil {
+			v = fn(v)
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[v] = true
+	}
+	return set
 }
 
 func init() { log.SetFlags(0); log.SetPrefix(filepath.Base(os.Args[0]) + ": ") }
 
 type handler struct {
-	gate  chan struct{}
-	d     time.Duration
-	token string
-	noisy bool
+	gate     *gate
+	renderer renderer
+	engineID string         // renderer command and its extra arguments, see cacheKey
+	office   renderer       // converts office documents, may be nil
+	urlRend  renderer       // converts documents at /url, renderer if nil
+	isolated bool           // renderers run in sandbox, see sandbox
+	tokens   *tokenSet      // tokens from -token-file, may be nil
+	slots    *tokenSlots    // conversion slots of -token-file tokens, may be nil
+	jwt      *jwtVerifier   // may be nil
+	signer   *requestSigner // verifies X-Signature, may be nil
+	noisy    atomic.Bool    // log details of each conversion
+
+	policy atomic.Pointer[policy] // settings changed by reload
+
+	mu    sync.Mutex        // serializes reloads
+	flags map[string]string // flag values process runs with
+
+	saturation time.Duration // report not ready if gate is full for this long
+
+	rlimits procLimits // renderer resource limits
+	tuner   *tuner     // adjusts gate size, may be nil
+
+	breaker         *breaker      // fails conversions fast while renderer is broken, may be nil
+	officeBreaker   *breaker      // same for office renderer, may be nil
+	breakerCooldown time.Duration // how long breakers stay open
+
+	retryCrashed bool         // run renderer once more if it's killed by a signal
+	retries      atomic.Int64 // number of such retries
+
+	limiter  *rateLimiter        // per-client rate and daily quota, may be nil
+	inflight *concurrencyLimiter // per-client concurrent requests, may be nil
+
+	templates *templateSet // templates served at /render/, may be nil
+	maxBody   int64        // upper bound of template output, unlimited if 0
+	fonts     *fontSet     // extra fonts of renderers, may be nil
+	fontAPI   bool         // manage fonts at admin listener
+	jobs      *jobStore    // asynchronous conversions
+	cache     *resultCache // converted documents, may be nil
+
+	urlHosts map[string]bool // hosts allowed at /url, endpoint disabled if nil
+
+	errorFormat string // format of error replies: text, json or problem
+
+	callbackSecret string // key to sign callback payloads with
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.Header().Set("Accept", "POST")
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	if !h.accept(w, r) {
 		return
 	}
-	if h.token != "" {
-		hdr := r.Header.Get("Authorization")
-		if val := strings.TrimPrefix(hdr, "Bearer "); val != hdr && val == h.token {
-			goto authorized
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "multipart/form-data":
+		if h.isolated {
+			h.serveMultipart(w, r)
+			return
 		}
-		w.Header().Set("WWW-Authenticate", "Bearer")
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		// documents could read files outside of the upload with file://
+		// urls, which only the sandbox prevents
+		h.error(w, http.StatusUnsupportedMediaType)
 		return
+	case "application/json":
+		h.serveTemplateJSON(w, r)
+		return
+	case "application/zip":
+		if h.isolated {
+			h.serveBundle(w, r)
+			return
+		}
+		h.error(w, http.StatusUnsupportedMediaType)
+		return
+	case "text/plain":
+		h.serveText(w, r)
+		return
+	}
+	if _, ok := officeTypes[mt]; ok && h.office != nil {
+		h.serveOffice(w, r)
+		return
+	}
+	if _, ok := imageTypes[mt]; ok {
+		h.serveImage(w, r)
+		return
+	}
+	if src, ok := h.htmlSource(w, r); ok {
+		h.serveConverted(w, r, src)
 	}
-authorized:
+}
+
+// htmlSource returns source reading html document from request body,
+// converted to utf8. If request has no valid html document, it replies with
+// an error and returns false.
+func (h *handler) htmlSource(w http.ResponseWriter, r *http.Request) (source, bool) {
 	ct := r.Header.Get("Content-Type")
 	if !strings.HasPrefix(ct, "text/html") {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+		h.error(w, http.StatusBadRequest)
+		return source{}, false
 	}
 	utf8Body, err := charset.NewReader(r.Body, ct)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		h.error(w, http.StatusUnsupportedMediaType)
+		return source{}, false
+	}
+	return source{r: utf8Body}, true
+}
+
+// accept checks request method and authorization. If request must not be
+// processed any further, it replies with an error and returns false.
+func (h *handler) accept(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Accept", "POST")
+		h.error(w, http.StatusMethodNotAllowed)
+		return false
+	}
+	return h.checkAuth(w, r)
+}
+
+// checkAuth replies with 401 Unauthorized and returns false if request is not
+// authorized.
+func (h *handler) checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		h.error(w, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// serveConverted converts document from src and replies with the resulting
+// PDF.
+func (h *handler) serveConverted(w http.ResponseWriter, r *http.Request, src source) {
+	opts, err := h.requestOptions(r)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if opts.sink != nil && !h.sinkAllowed(opts.sink) {
+		h.error(w, http.StatusForbidden)
 		return
 	}
-	rd, err := h.convert(r.Context(), utf8Body)
+	if src.userCSS != "" {
+		// X-Pdf-User-Stylesheet header goes after uploaded stylesheet, so it
+		// can override it
+		css := src.userCSS
+		if opts.userCSS != "" {
+			css += "\n" + opts.userCSS
+		}
+		opts.userCSS = css
+	}
+	// documents converted from the same input with the same options are
+	// identical, unless they're encrypted with random salt
+	var key, etag string
+	if src.r != nil && opts.encrypt == nil {
+		// document is hashed on its way to a temporary file rather than
+		// kept in memory, as it may be as large as -max-body-size
+		f, err := os.CreateTemp("", "pdfsvc-input-")
+		if err != nil {
+			ctxLogger(r.Context()).Error("creating input file failed", "error", err)
+			h.error(w, http.StatusInternalServerError)
+			return
+		}
+		os.Remove(f.Name())
+		defer f.Close()
+		if key, err = cacheKey(f, src.r, h.engineID+h.fonts.version(), opts); err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			h.error(w, http.StatusInternalServerError)
+			return
+		}
+		src.r = f
+		if opts.sink == nil && !acceptsJSON(r) {
+			// converted documents are not byte-identical, i.e. their
+			// creation dates differ, so the tag can only be weak; this
+			// also keeps If-Range from splicing ranges of two documents
+			etag = `W/"` + key + `"`
+			if etagMatch(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Set("ETag", etag)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	if key != "" && h.cache != nil {
+		if f := h.cache.get(key); f != nil {
+			defer f.Close()
+			w.Header().Set("X-Cache", "HIT")
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+			h.serveResult(w, r, opts, &result{File: f})
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+	switch p := h.policy.Load(); {
+	case src.url != "":
+		opts.timeout = p.urlTimeout
+	case p.perKB > 0:
+		size := inputSize(r, src.r)
+		opts.timeout = h.scaledTimeout(size)
+		if h.noisy.Load() {
+			ctxLogger(r.Context()).Info("timeout scaled", "input_size", size, "timeout", opts.timeout)
+		}
+	}
+	res, err := h.convert(r.Context(), src, opts)
 	if err != nil {
-		code := http.StatusInternalServerError
-		if err == context.DeadlineExceeded {
-			code = http.StatusGatewayTimeout
+		h.conversionError(w, err)
+		return
+	}
+	defer res.Close()
+	// renderer warnings may be caused by transient failures, like missing
+	// images, don't keep such documents
+	if key != "" && h.cache != nil && res.warning == "" && len(res.warnings) == 0 {
+		if err := h.cache.put(key, res); err != nil {
+			ctxLogger(r.Context()).Error("caching result failed", "error", err)
+		}
+	}
+	if etag != "" && res.warning == "" {
+		w.Header().Set("ETag", etag)
+	}
+	h.serveResult(w, r, opts, res)
+}
+
+// etagMatch reports whether If-None-Match header value matches etag using
+// weak comparison
+func etagMatch(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// conversionError replies with an error matching the conversion failure
+func (h *handler) conversionError(w http.ResponseWriter, err error) {
+	p := problem{Status: http.StatusInternalServerError, Code: "conversion_failed"}
+	var re *rendererError
+	switch {
+	case err == context.DeadlineExceeded:
+		p.Status, p.Code = http.StatusGatewayTimeout, "timeout"
+	case err == errQueueFull, err == errQueueTimeout:
+		p.Status, p.Code = http.StatusServiceUnavailable, "overloaded"
+		w.Header().Set("Retry-After", strconv.Itoa(shedRetryAfter))
+	case err == errBreakerOpen:
+		p.Status, p.Code = http.StatusServiceUnavailable, "renderer_unavailable"
+		w.Header().Set("Retry-After", strconv.Itoa(int(h.breakerCooldown.Seconds())))
+	case errors.Is(err, errUnsupported):
+		p.Status, p.Code = http.StatusBadRequest, "unsupported_options"
+	case err == errPageRange:
+		p.Status, p.Code = http.StatusRequestedRangeNotSatisfiable, "page_range_invalid"
+	case err == errOutputLimit:
+		p.Status, p.Code = http.StatusRequestEntityTooLarge, "output_too_large"
+	case err == errCPULimit, err == errMemoryLimit:
+		p.Status, p.Code = http.StatusInsufficientStorage, "resource_limit_exceeded"
+	case errors.As(err, &re):
+		p.Code, p.Stderr = "renderer_failed", re.stderrTail()
+	}
+	if h.errorFormat != "problem" {
+		h.error(w, p.Status)
+		return
+	}
+	if p.Code != "conversion_failed" {
+		// other errors may reveal internal details
+		p.Detail = err.Error()
+	}
+	h.problem(w, p)
+}
+
+// serveResult replies with the converted document, or uploads it to the sink
+// if opts has one.
+func (h *handler) serveResult(w http.ResponseWriter, r *http.Request, opts options, res *result) {
+	p := h.policy.Load()
+	p.addHeaders(w.Header())
+	if res.warning != "" {
+		w.Header().Set("X-Pdf-Warning", res.warning)
+	}
+	for _, s := range res.warnings {
+		w.Header().Add("X-Pdf-Warnings", s)
+	}
+	w.Header().Set("X-Pdf-Queue-Wait", res.queued.String())
+	w.Header().Set("X-Pdf-Render-Time", res.rendered.String())
+	if res.ps != nil {
+		w.Header().Set("X-Pdf-Renderer-Exit-Code", strconv.Itoa(res.ps.ExitCode()))
+		w.Header().Set("X-Pdf-Renderer-Cpu-Time", (res.ps.UserTime() + res.ps.SystemTime()).String())
+		if ru, ok := res.ps.SysUsage().(*syscall.Rusage); ok {
+			w.Header().Set("X-Pdf-Renderer-Max-Rss", strconv.FormatInt(int64(ru.Maxrss)<<10, 10))
+		}
+	}
+	pages, err := countPages(r.Context(), res.File)
+	if err == nil {
+		w.Header().Set("X-Pdf-Pages", strconv.Itoa(pages))
+	} else if h.noisy.Load() {
+		ctxLogger(r.Context()).Info("counting pages failed", "error", err)
+	}
+	if fi, err := res.Stat(); err == nil {
+		h.limiter.account(h.clientKey(r), fi.Size(), pages)
+	}
+	if opts.sink != nil {
+		n, err := upload(r.Context(), opts.sink, res)
+		if err != nil {
+			ctxLogger(r.Context()).Error("sink upload failed", "error", err)
+			h.error(w, http.StatusBadGateway)
+			return
+		}
+		// presigned urls carry credentials in query, only report object
+		// location
+		loc := *opts.sink
+		loc.RawQuery, loc.Fragment, loc.User = "", "", nil
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Bytes int64  `json:"bytes"`
+			URL   string `json:"url"`
+		}{n, loc.String()})
+		return
+	}
+	if acceptsJSON(r) {
+		if err := writeJSONResult(w, res); err != nil && h.noisy.Load() {
+			ctxLogger(r.Context()).Info("writing JSON reply failed", "error", err)
 		}
-		http.Error(w, http.StatusText(code), code)
 		return
 	}
 	w.Header().Set("Content-Type", "application/pdf")
-	http.ServeContent(w, r, "", time.Now(), rd)
+	name := opts.filename
+	if name == "" && p.filename != "" {
+		name = docFilename(p.filename, opts, time.Now())
+	}
+	if name != "" {
+		w.Header().Set("Content-Disposition", contentDisposition(name))
+	}
+	if r.Header.Get("If-Range") != "" {
+		// documents have no strong validator to resume download against,
+		// and http.ServeContent only checks If-Range of GET requests
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, "", time.Now(), res)
+}
+
+// inputSize returns size of the request input document in bytes, or 0 if it's
+// unknown.
+func inputSize(r *http.Request, body io.Reader) int64 {
+	if b, ok := body.(interface{ Len() int }); ok {
+		return int64(b.Len())
+	}
+	if r.ContentLength > 0 {
+		return r.ContentLength
+	}
+	// bodies of unknown length are buffered to files by buffering.Handler
+	if s, ok := r.Body.(io.Seeker); ok {
+		cur, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0
+		}
+		size, err := s.Seek(0, io.SeekEnd)
+		if _, err2 := s.Seek(cur, io.SeekStart); err != nil || err2 != nil {
+			return 0
+		}
+		return size
+	}
+	return 0
+}
+
+// scaledTimeout returns conversion timeout for input of a given size: base
+// timeout is increased by perKB for every KiB of input, bounded by maxTimeout.
+func (h *handler) scaledTimeout(size int64) time.Duration {
+	p := h.policy.Load()
+	if p.d <= 0 {
+		return 0
+	}
+	d := p.d + time.Duration(size>>10)*p.perKB
+	if p.maxTimeout > 0 && d > p.maxTimeout {
+		d = p.maxTimeout
+	}
+	return d
+}
+
+// acceptsJSON reports whether client asked for JSON reply instead of a PDF
+// document using Accept header.
+func acceptsJSON(r *http.Request) bool {
+	var ok bool
+	for _, v := range r.Header.Values("Accept") {
+		for _, s := range strings.Split(v, ",") {
+			s, _, _ = strings.Cut(s, ";")
+			switch strings.TrimSpace(s) {
+			case "application/pdf":
+				return false
+			case "application/json":
+				ok = true
+			}
+		}
+	}
+	return ok
+}
+
+// writeJSONResult writes res as a JSON object holding base64-encoded PDF
+// document, its size, render time, and renderer warnings if there are any:
+//
+//	{"pdf":"JVBERi0...","bytes":1234,"durationMs":567,"warnings":["ERROR: ..."]}
+func writeJSONResult(w http.ResponseWriter, res *result) error {
+	size, err := res.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := res.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tail := fmt.Sprintf(`","bytes":%d,"durationMs":%d`, size, res.rendered.Milliseconds())
+	if len(res.warnings) != 0 {
+		b, err := json.Marshal(res.warnings)
+		if err != nil {
+			return err
+		}
+		tail += `,"warnings":` + string(b)
+	}
+	tail += "}\n"
+	const head = `{"pdf":"`
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(head)+
+		base64.StdEncoding.EncodedLen(int(size))+len(tail)))
+	if _, err := io.WriteString(w, head); err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(enc, res); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, tail)
+	return err
+}
+
+// error replies to the request with the specified HTTP code, formatting
+// response body as configured by the handler's errorFormat field.
+func (h *handler) error(w http.ResponseWriter, code int) {
+	switch h.errorFormat {
+	case "problem":
+		h.problem(w, problem{Status: code})
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+		}{http.StatusText(code), code})
+	default:
+		http.Error(w, http.StatusText(code), code)
+	}
+}
+
+// selfTest converts a tiny known document and checks that the result looks
+// like a PDF.
+func (h *handler) selfTest() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := h.convert(ctx, source{r: strings.NewReader(selfTestDocument)}, options{})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	if res.warning != "" {
+		return errors.New(res.warning)
+	}
+	if !isPDF(res) {
+		return errors.New("output is not a PDF document")
+	}
+	return nil
+}
+
+const selfTestDocument = `<!DOCTYPE html><html><head><meta charset="utf-8"><title>pdfsvc</title></head>
+<body><h1>Self-test</h1><p>Lorem ipsum dolor sit amet, ½ € ü ж 中文</p></body></html>`
+
+// isPDF reports whether rd starts with PDF file signature. It leaves rd
+// positioned at its start.
+func isPDF(rd io.ReadSeeker) bool {
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	defer rd.Seek(0, io.SeekStart)
+	sig := make([]byte, 5)
+	if _, err := io.ReadFull(rd, sig); err != nil {
+		return false
+	}
+	return string(sig) == "%PDF-"
+}
+
+// result is a document produced by the renderer, stored in an unlinked
+// temporary file. It must be closed after use.
+type result struct {
+	*os.File
+	// warning is non-empty if renderer reported an error, but its output
+	// was still accepted, see handler.lenient
+	warning string
+	// warnings are non-fatal messages renderer reported, see parseWarnings
+	warnings []string
+
+	queued   time.Duration // time spent waiting for a free conversion slot
+	rendered time.Duration // time spent running renderer
+
+	ps *os.ProcessState // state of the finished renderer process, may be nil
+}
+
+// source is a document to convert: either utf8-encoded html read from r, a
+// document at url, or a local html file.
+type source struct {
+	r    io.Reader
+	url  string
+	file string
+
+	cover  string // html document file converted as cover page, if set
+	office bool   // file is an office document, converted with handler.office
+
+	userCSS string // user stylesheet uploaded along with the document
 }
 
-func (h *handler) convert(ctx context.Context, r io.Reader) (io.ReadSeeker, error) {
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case h.gate <- struct{}{}:
-		defer func() { <-h.gate }()
+// convert renders document from src and applies post-processing options to
+// the result. Caller must close returned result.
+func (h *handler) convert(ctx context.Context, src source, opts options) (*result, error) {
+	res, err := h.render(ctx, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	if src.cover != "" {
+		if err := h.prependCover(ctx, res, src.cover, opts); err != nil {
+			res.Close()
+			return nil, err
+		}
 	}
-	if h.d > 0 {
+	if err := h.postProcess(ctx, res, opts); err != nil {
+		res.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// render waits for a free conversion slot and runs renderer on src
+func (h *handler) render(ctx context.Context, src source, opts options) (*result, error) {
+	rd, b := h.renderer, h.breaker
+	if src.office {
+		// office documents are not html, renderer rejects html options
+		rd, b = h.office, h.officeBreaker
+	} else {
+		if src.url != "" && h.urlRend != nil {
+			rd = h.urlRend
+		}
+		if opts.toc {
+			var err error
+			if src, err = applyTOC(src); err != nil {
+				return nil, err
+			}
+		}
+	}
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	verdict := outcomeUnknown
+	defer func() { b.done(probe, verdict) }()
+	begin := time.Now()
+	if g := tokenGate(ctx); g != nil {
+		if err := g.acquire(ctx, opts.priority); err != nil {
+			return nil, err
+		}
+		defer g.release()
+	}
+	if err := h.gate.acquire(ctx, opts.priority); err != nil {
+		return nil, err
+	}
+	defer h.gate.release()
+	queued := time.Since(begin)
+	d := h.policy.Load().d
+	if opts.timeout > 0 {
+		d = opts.timeout
+	}
+	if d > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, h.d)
+		ctx, cancel = context.WithTimeout(ctx, d)
 		defer cancel()
 	}
-	cmd := exec.CommandContext(ctx, "weasyprint", "--encoding", "utf8", "--quiet", "-", "-")
-	cmd.Stdin = r
-	// FIXME: we're suggesting that returned bodies are quite small, may not
-	// always be the case, but ok for controlled inputs
-	out, err := cmd.Output()
-	if h.noisy {
+	stderr := &limitedBuffer{max: maxStderrSize}
+	out, err := os.CreateTemp("", "pdfsvc-result-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(out.Name())
+	var input []byte
+	if h.retryCrashed && src.r != nil {
+		// keep input to feed it to renderer again on retry
+		if input, err = io.ReadAll(src.r); err != nil {
+			out.Close()
+			return nil, err
+		}
+		src.r = bytes.NewReader(input)
+	}
+	begin = time.Now()
+	ps, err := rd.render(ctx, src, opts, out, stderr)
+	if err != nil && h.retryCrashed && exitSignal(ps) != 0 && ctx.Err() == nil &&
+		h.rlimits.exceeded(ps, stderr.Bytes()) == nil {
+		ctxLogger(ctx).Warn("renderer crashed, retrying", "exit", exitstatus.Reason(err))
+		h.retries.Add(1)
+		if err := resetFile(out); err != nil {
+			out.Close()
+			return nil, err
+		}
+		stderr.Reset()
+		if input != nil {
+			src.r = bytes.NewReader(input)
+		}
+		ps, err = rd.render(ctx, src, opts, out, stderr)
+	}
+	rendered := time.Since(begin)
+	h.tuner.observe(rendered)
+	addRenderStats(ctx, queued, rendered, ps)
+	l := ctxLogger(ctx)
+	if h.noisy.Load() {
+		attrs := []any{
+			"exit", exitstatus.Reason(err),
+			"queued", queued.Round(time.Millisecond),
+			"duration", rendered.Round(time.Millisecond),
+		}
+		attrs = append(attrs, processAttrs(ps)...)
 		select {
 		case <-ctx.Done():
-			log.Print(exitstatus.Reason(err), " / ", exitstatus.Stats(cmd.ProcessState), ", ", ctx.Err())
+			attrs = append(attrs, "error", ctx.Err())
 		default:
-			log.Print(exitstatus.Reason(err), " / ", exitstatus.Stats(cmd.ProcessState))
+			if deadline, ok := ctx.Deadline(); ok {
+				attrs = append(attrs, "time_left", time.Until(deadline).Round(time.Millisecond))
+			}
+		}
+		l.Info("conversion finished", attrs...)
+		if b := bytes.TrimSpace(stderr.Bytes()); len(b) != 0 {
+			l.Info("renderer stderr", "output", string(b))
 		}
 	}
+	res := &result{File: out, queued: queued, rendered: rendered, ps: ps,
+		warnings: parseWarnings(stderr.Bytes(), opts.warnLevel)}
 	if err != nil {
 		select {
 		case <-ctx.Done():
+			out.Close()
+			if ctx.Err() == context.DeadlineExceeded && h.gate.idle() {
+				// renderer hung while it had the machine to itself
+				verdict = outcomeFailure
+			}
 			return nil, ctx.Err()
 		default:
 		}
+		if err := h.rlimits.exceeded(ps, stderr.Bytes()); err != nil {
+			out.Close()
+			l.Warn("conversion failed", "error", err)
+			return nil, err
+		}
+		if h.policy.Load().lenient && isPDF(out) {
+			res.warning = "renderer " + exitstatus.Reason(err)
+			l.Warn("serving output of failed conversion", "warning", res.warning)
+			verdict = outcomeSuccess
+			return res, nil
+		}
+		out.Close()
+		// non-zero exit code is usually caused by the document, only count
+		// failures of the renderer itself
+		if startFailed(err) || exitSignal(ps) != 0 {
+			verdict = outcomeFailure
+		}
+		return nil, &rendererError{err: err, stderr: bytes.Clone(stderr.Bytes())}
+	}
+	verdict = outcomeSuccess
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		out.Close()
 		return nil, err
 	}
-	return bytes.NewReader(out), nil
+	return res, nil
+}
+
+// resetFile truncates f and rewinds it to its start
+func resetFile(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// maxStderrSize limits how much of renderer's stderr output is kept
+const maxStderrSize = 16 << 10
+
+// limitedBuffer is a bytes.Buffer that silently discards writes past its max
+// size.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.Len(); n < len(p) {
+		if n > 0 {
+			b.Buffer.Write(p[:n])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHandler returns handler running shell script as its renderer, with
+// policy from default flags changed by fn, if it's not nil
+func newTestHandler(t *testing.T, script string, fn func(*cmdArgs)) *handler {
+	t.Helper()
+	dir := t.TempDir()
+	name := filepath.Join(dir, "weasyprint")
+	if err := os.WriteFile(name, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	args := defaultArgs()
+	if fn != nil {
+		fn(args)
+	}
+	p, err := newPolicy(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{gate: newGate(1, time.Second), renderer: weasyPrint{}}
+	h.policy.Store(p)
+	return h
+}
+
+func TestConvertNonZeroExit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		script  string
+		lenient bool
+		ok      bool
+	}{
+		{"pdf", "cat >/dev/null; printf '%%PDF-1.7\\n'; exit 1", false, false},
+		{"lenient pdf", "cat >/dev/null; printf '%%PDF-1.7\\n'; exit 1", true, true},
+		{"lenient not pdf", "cat >/dev/null; echo oops; exit 1", true, false},
+		{"lenient empty", "cat >/dev/null; exit 1", true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, tc.script, func(args *cmdArgs) { args.Lenient = tc.lenient })
+			res, err := h.convert(context.Background(), source{r: strings.NewReader("<p>hi")}, options{})
+			if !tc.ok {
+				var rerr *rendererError
+				if !errors.As(err, &rerr) {
+					t.Fatalf("got error %v, want rendererError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.warning == "" {
+				t.Error("result has no warning")
+			}
+			b, err := io.ReadAll(res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(b), "%PDF-") {
+				t.Errorf("got output %q, want PDF", b)
+			}
+		})
+	}
+}
+
+func TestConvertedTimings(t *testing.T) {
+	h := newTestHandler(t, "cat >/dev/null; sleep 0.1; printf '%%PDF-1.7\\n'", nil)
+	r := httptest.NewRequest("POST", "/", strings.NewReader("<p>hi"))
+	r.Header.Set("Content-Type", "text/html")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, k := range []string{"X-Pdf-Queue-Wait", "X-Pdf-Render-Time"} {
+		s := w.Header().Get(k)
+		if s == "" {
+			t.Errorf("%s header is missing", k)
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			t.Errorf("%s: %v", k, err)
+			continue
+		}
+		if d < 0 {
+			t.Errorf("%s: got negative duration %v", k, d)
+		}
+	}
+	if d, _ := time.ParseDuration(w.Header().Get("X-Pdf-Render-Time")); d < 100*time.Millisecond {
+		t.Errorf("got render time %v, want at least 100ms renderer ran", d)
+	}
+}
+
+func TestScaledTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		d, perKB     time.Duration
+		max          time.Duration
+		small, large time.Duration // timeouts of 1KiB and 300KiB input
+	}{
+		{"fixed", 5 * time.Second, 0, 0, 5 * time.Second, 5 * time.Second},
+		{"scaled", 5 * time.Second, 100 * time.Millisecond, 0, 5100 * time.Millisecond, 35 * time.Second},
+		{"clamped", 5 * time.Second, 100 * time.Millisecond, 20 * time.Second, 5100 * time.Millisecond, 20 * time.Second},
+		{"unlimited", 0, 100 * time.Millisecond, 20 * time.Second, 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, "", func(args *cmdArgs) {
+				args.Timeout, args.PerKB, args.MaxD = tc.d, tc.perKB, tc.max
+			})
+			if got := h.scaledTimeout(1 << 10); got != tc.small {
+				t.Errorf("small input: got %v, want %v", got, tc.small)
+			}
+			if got := h.scaledTimeout(300 << 10); got != tc.large {
+				t.Errorf("large input: got %v, want %v", got, tc.large)
+			}
+		})
+	}
+}
+
+// newTestResult returns result holding a stub PDF document
+func newTestResult(t *testing.T) *result {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "result-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("%PDF-1.7\n%%EOF\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return &result{File: f, queued: 20 * time.Millisecond, rendered: 300 * time.Millisecond}
+}
+
+func TestServeResultHeaders(t *testing.T) {
+	h := newTestHandler(t, "", func(args *cmdArgs) {
+		for _, s := range []string{
+			"X-Content-Type-Options: nosniff",
+			"Cache-Control: private",
+			"Vary: Origin",
+		} {
+			if err := args.Headers.Set(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	c := &compressor{minSize: 1 << 10}
+	handler := c.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.serveResult(w, r, options{}, newTestResult(t))
+	}))
+	for range 2 {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		for k, want := range map[string][]string{
+			"X-Content-Type-Options": {"nosniff"},
+			"Cache-Control":          {"private"},
+			"Vary":                   {"Accept-Encoding", "Origin"},
+		} {
+			if got := w.Header().Values(k); !slices.Equal(got, want) {
+				t.Errorf("%s: got %q, want %q", k, got, want)
+			}
+		}
+	}
+	if got := h.policy.Load().headers.Values("Vary"); !slices.Equal(got, []string{"Origin"}) {
+		t.Errorf("configured Vary header changed to %q", got)
+	}
+}
+
+func TestConvertedETag(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "input.html")
+	h := newTestHandler(t, "cat >"+input+"; printf '%%PDF-1.7\\n'", nil)
+	doc := strings.Repeat("<p>hi</p>\n", 1<<12)
+	post := func(hdr ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(doc))
+		r.Header.Set("Content-Type", "text/html")
+		for i := 0; i+1 < len(hdr); i += 2 {
+			r.Header.Set(hdr[i], hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := post()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if b, err := os.ReadFile(input); err != nil || string(b) != doc {
+		t.Fatalf("renderer got %d bytes of input (%v), want %d", len(b), err, len(doc))
+	}
+	// documents converted anew are not byte-identical
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("got ETag %q, want weak one", etag)
+	}
+	for _, inm := range []string{etag, strings.TrimPrefix(etag, "W/"), `"other", ` + etag} {
+		if w := post("If-None-Match", inm); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: got status %d, want %d", inm, w.Code, http.StatusNotModified)
+		}
+	}
+	if w := post("If-None-Match", `"other"`); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match of other document: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := post("Range", "bytes=2-"); w.Code != http.StatusPartialContent {
+		t.Errorf("Range: got status %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	// ranges of a weakly tagged document can't be resumed
+	if w := post("Range", "bytes=2-", "If-Range", etag); w.Code != http.StatusOK {
+		t.Errorf("If-Range: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// postProcess applies options that modify rendered document with qpdf,
+// replacing contents of res with the modified document.
+func (h *handler) postProcess(ctx context.Context, res *result, opts options) error {
+	qargs := opts.qpdfArgs()
+	if len(qargs) == 0 && opts.watermark == "" && opts.meta.empty() {
+		return nil
+	}
+	if opts.pageRange != "" {
+		n, err := countPages(ctx, res.File)
+		if err != nil {
+			return err
+		}
+		if lastPage(opts.pageRange) > n {
+			return errPageRange
+		}
+	}
+	dir, err := os.MkdirTemp("", "pdfsvc-post-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if opts.watermark != "" {
+		name := filepath.Join(dir, "watermark.pdf")
+		if err := h.renderWatermark(ctx, name, opts); err != nil {
+			return err
+		}
+		qargs = append(qargs, "--overlay", name, "--repeat=1", "--")
+	}
+	input := filepath.Join(dir, "input.pdf")
+	output := filepath.Join(dir, "output.pdf")
+	if err := writeFile(input, res); err != nil {
+		return err
+	}
+	if !opts.meta.empty() {
+		name := filepath.Join(dir, "info.json")
+		if err := opts.meta.writeInfoUpdate(ctx, input, name); err != nil {
+			return err
+		}
+		qargs = append(qargs, "--update-from-json="+name)
+	}
+	// arguments may hold passwords, pass them in a file so that they're not
+	// exposed in process list
+	argsFile := filepath.Join(dir, "args")
+	lines := append(append([]string{input}, qargs...), output)
+	if err := os.WriteFile(argsFile, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := runQpdf(ctx, "@"+argsFile); err != nil {
+		return err
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	res.File.Close()
+	res.File = f
+	return nil
+}
+
+// qpdfArgs returns qpdf options implementing post-processing options, or nil
+// if document needs no post-processing
+func (o options) qpdfArgs() []string {
+	var args []string
+	if o.pageRange != "" {
+		// "." refers to the primary input file
+		args = append(args, "--pages", ".", o.pageRange, "--")
+	}
+	if o.encrypt != nil {
+		args = append(args, o.encrypt.qpdfArgs()...)
+	}
+	if o.optimize {
+		args = append(args, optimizeArgs...)
+	}
+	if o.linearize {
+		args = append(args, "--linearize")
+	}
+	return args
+}
+
+// optimizeArgs are qpdf options shrinking document size: streams are
+// recompressed with the highest compression level, images that can be are
+// recompressed as JPEG, and objects are packed into compressed object streams
+var optimizeArgs = []string{
+	"--object-streams=generate",
+	"--compress-streams=y",
+	"--recompress-flate",
+	"--compression-level=9",
+	"--optimize-images",
+	"--remove-unreferenced-resources=yes",
+}
+
+// pageRange matches page ranges allowed in X-Pdf-Page-Range header, i.e.
+// "1-3,7"
+var pageRange = regexp.MustCompile(`^[1-9][0-9]{0,5}(-[1-9][0-9]{0,5})?(,[1-9][0-9]{0,5}(-[1-9][0-9]{0,5})?){0,99}$`)
+
+// errPageRange is returned when page range refers to pages document doesn't
+// have
+var errPageRange = errors.New("page range is out of document bounds")
+
+// lastPage returns the highest page number in a range matching pageRange
+func lastPage(s string) int {
+	var last int
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '-' }) {
+		if n, _ := strconv.Atoi(f); n > last {
+			last = n
+		}
+	}
+	return last
+}
+
+// maxWatermarkLen is max length of X-Pdf-Watermark value
+const maxWatermarkLen = 100
+
+// renderWatermark renders a single page PDF document with watermark text
+// from opts to the named file
+func (h *handler) renderWatermark(ctx context.Context, name string, opts options) error {
+	doc := strings.NewReader(`<!doctype html><meta charset="utf-8"><style>
+@page { margin: 0 }
+html, body { margin: 0; height: 100% }
+body { display: flex; align-items: center; justify-content: center }
+p { font: bold 72px sans-serif; color: rgba(128, 128, 128, 0.3);
+	transform: rotate(-45deg); white-space: nowrap }
+</style><p>` + html.EscapeString(opts.watermark) + `</p>`)
+	// watermark page must match document page size, but not its margins
+	wopts := options{priority: opts.priority, timeout: opts.timeout}
+	wopts.page.size, wopts.page.orientation = opts.page.size, opts.page.orientation
+	res, err := h.render(ctx, source{r: doc}, wopts)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	return writeFile(name, res)
+}
+
+// encryption holds document protection settings
+type encryption struct {
+	userPassword  string // required to open document, may be empty
+	ownerPassword string // required to lift restrictions
+	noPrint       bool
+	noCopy        bool
+	noModify      bool
+}
+
+// parseEncryption extracts encryption settings from X-Pdf-User-Password,
+// X-Pdf-Owner-Password and X-Pdf-Permissions headers. It returns nil if none
+// of them are set. If only restrictions are set, owner password is randomly
+// generated.
+func parseEncryption(hdr http.Header) (*encryption, error) {
+	user := hdr.Get("X-Pdf-User-Password")
+	owner := hdr.Get("X-Pdf-Owner-Password")
+	perms := hdr.Get("X-Pdf-Permissions")
+	if user == "" && owner == "" && perms == "" {
+		return nil, nil
+	}
+	e := &encryption{userPassword: user, ownerPassword: owner}
+	for _, p := range strings.Split(perms, ",") {
+		switch strings.ToLower(strings.TrimSpace(p)) {
+		case "":
+		case "no-print":
+			e.noPrint = true
+		case "no-copy":
+			e.noCopy = true
+		case "no-modify":
+			e.noModify = true
+		default:
+			return nil, errors.New("unsupported X-Pdf-Permissions value")
+		}
+	}
+	if e.ownerPassword == "" {
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, err
+		}
+		e.ownerPassword = hex.EncodeToString(b)
+	}
+	return e, nil
+}
+
+// qpdfArgs returns qpdf options encrypting document with AES-256
+func (e *encryption) qpdfArgs() []string {
+	args := []string{"--encrypt", "--owner-password=" + e.ownerPassword, "--bits=256"}
+	if e.userPassword != "" {
+		args = append(args, "--user-password="+e.userPassword)
+	}
+	if e.noPrint {
+		args = append(args, "--print=none")
+	}
+	if e.noCopy {
+		args = append(args, "--extract=n")
+	}
+	if e.noModify {
+		args = append(args, "--modify=none")
+	}
+	return append(args, "--")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/artyom/exitstatus"
+)
+
+// maxProblemStderr limits how much of renderer stderr output is included in
+// problem details
+const maxProblemStderr = 4 << 10
+
+// rendererError is returned when renderer command fails
+type rendererError struct {
+	err    error
+	stderr []byte
+}
+
+func (e *rendererError) Error() string { return "renderer " + exitstatus.Reason(e.err) }
+func (e *rendererError) Unwrap() error { return e.err }
+
+// stderrTail returns the end of renderer output, where errors are usually
+// reported, truncated to maxProblemStderr bytes
+func (e *rendererError) stderrTail() string {
+	b := bytes.TrimSpace(e.stderr)
+	if len(b) > maxProblemStderr {
+		b = b[len(b)-maxProblemStderr:]
+		for len(b) != 0 && !utf8.RuneStart(b[0]) {
+			b = b[1:]
+		}
+	}
+	return string(b)
+}
+
+// problem is an RFC 9457 problem details object, sent on errors with
+// -error-format=problem
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Code      string `json:"code"` // machine-readable error code
+	RequestID string `json:"request_id,omitempty"`
+	Stderr    string `json:"stderr,omitempty"` // renderer output
+}
+
+// problem replies with problem details. Fields left empty are filled in from
+// the status code, request id is taken from the response headers.
+func (h *handler) problem(w http.ResponseWriter, p problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Code == "" {
+		p.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(p.Status)), " ", "_")
+	}
+	p.RequestID = w.Header().Get("X-Request-Id")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// resourceProxy is an HTTP proxy renderers fetch external resources through.
+// It only allows requests to hosts from its allowlist, tunnels only to port
+// 443, and never connects to loopback, link-local or private addresses, such
+// as cloud metadata endpoints or internal services.
+type resourceProxy struct {
+	hosts     map[string]bool
+	dialer    *net.Dialer
+	transport *http.Transport
+}
+
+// startResourceProxy starts proxy allowing given hosts on a random loopback
+// port, and returns its url
+func startResourceProxy(hosts map[string]bool) (string, error) {
+	p := &resourceProxy{hosts: hosts, dialer: &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: checkDialAddr,
+	}}
+	p.transport = &http.Transport{
+		DialContext:           p.dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConnsPerHost:   4,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	srv := &http.Server{Handler: p, ReadHeaderTimeout: time.Second}
+	go func() { slog.Error("resource proxy failed", "error", srv.Serve(ln)) }()
+	return "http://" + ln.Addr().String(), nil
+}
+
+// checkDialAddr is a net.Dialer Control function refusing connections to
+// loopback, link-local and private (RFC 1918, RFC 4193) addresses
+func checkDialAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsPrivate() || ip.IsUnspecified() {
+		return errors.New("address not allowed: " + host)
+	}
+	return nil
+}
+
+// hopHeaders are removed from proxied requests and replies
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func (p *resourceProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.URL.Hostname())
+	if !p.hosts[host] {
+		slog.Info("resource request denied", "method", r.Method, "host", host)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		// tunnels are only used for https, don't let them reach other
+		// services of allowed hosts
+		if r.URL.Port() != "443" {
+			slog.Info("resource request denied", "method", r.Method, "host", r.URL.Host)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		p.serveConnect(w, r)
+		return
+	}
+	if r.URL.Scheme != "http" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	for _, k := range hopHeaders {
+		req.Header.Del(k)
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		slog.Info("resource request failed", "url", r.URL.String(), "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, k := range hopHeaders {
+		resp.Header.Del(k)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// serveConnect tunnels CONNECT request, used for https resources
+func (p *resourceProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), p.dialer.Timeout)
+	defer cancel()
+	upstream, err := p.dialer.DialContext(ctx, "tcp", r.URL.Host)
+	if err != nil {
+		slog.Info("resource request failed", "host", r.URL.Host, "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, buf)
+		upstream.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+	<-done
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckDialAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1::1]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"10.1.2.3:443", false},
+		{"172.16.0.1:443", false},
+		{"172.31.255.255:443", false},
+		{"172.32.0.1:443", true},
+		{"192.168.1.1:443", false},
+		{"[fc00::1]:443", false},
+		{"[fd12:3456::1]:443", false},
+		{"[::ffff:10.0.0.1]:443", false},
+		{"0.0.0.0:80", false},
+		{"localhost:80", false},
+	} {
+		err := checkDialAddr("tcp", tc.addr, nil)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%s: got error %v, want allowed %v", tc.addr, err, tc.ok)
+		}
+	}
+}
+
+func TestProxyConnectPort(t *testing.T) {
+	p := &resourceProxy{hosts: map[string]bool{"example.com": true}}
+	for _, host := range []string{"example.com:22", "example.com:80", "other.com:443"} {
+		r := httptest.NewRequest(http.MethodConnect, "http://"+host, nil)
+		r.URL.Scheme, r.URL.Path = "", ""
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("CONNECT %s: got status %d, want %d", host, w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// runQpdf runs qpdf command with given arguments. Warnings qpdf reports on
+// recoverable problems with its input are not treated as errors.
+func runQpdf(ctx context.Context, args ...string) error {
+	stderr := &limitedBuffer{max: maxStderrSize}
+	cmd := exec.CommandContext(ctx, "qpdf", append([]string{"--warning-exit-0"}, args...)...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if b := bytes.TrimSpace(stderr.Bytes()); len(b) != 0 {
+			return fmt.Errorf("qpdf: %w: %s", err, b)
+		}
+		return fmt.Errorf("qpdf: %w", err)
+	}
+	return nil
+}
+
+// mergePDFs concatenates named PDF files, returning the resulting document
+// as an unlinked temporary file. Caller must close it. Document information
+// of the merged document is taken from the first file.
+func mergePDFs(ctx context.Context, names []string) (*os.File, error) {
+	dir, err := os.MkdirTemp("", "pdfsvc-merge-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output.pdf")
+	// first document is used as primary input, so that merged document
+	// keeps its metadata
+	args := append([]string{names[0], "--pages"}, names...)
+	if err := runQpdf(ctx, append(args, "--", output)...); err != nil {
+		return nil, err
+	}
+	return os.Open(output)
+}
+
+// countPages returns number of pages of PDF document f
+func countPages(ctx context.Context, f *os.File) (int, error) {
+	// f may be unlinked, so qpdf reads it as its stdin
+	cmd := exec.CommandContext(ctx, "qpdf", "--show-npages", "/dev/stdin")
+	cmd.Stdin = f
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("qpdf: %w", err)
+	}
+	return strconv.Atoi(string(bytes.TrimSpace(out)))
+}
+
+// qpdfObject is an object in qpdf JSON v2 format, see
+// https://qpdf.readthedocs.io/en/stable/json.html
+type qpdfObject struct {
+	Value any `json:"value"`
+}
+
+// qpdfObjects returns qpdf JSON header and given object of PDF file name;
+// obj is either "trailer" or object number and generation separated by
+// comma
+func qpdfObjects(ctx context.Context, name, obj string) (map[string]any, map[string]qpdfObject, error) {
+	out, err := exec.CommandContext(ctx, "qpdf", "--json=2", "--json-key=qpdf",
+		"--json-object="+obj, name).Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("qpdf: %w", err)
+	}
+	var doc struct {
+		Qpdf []json.RawMessage `json:"qpdf"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return nil, nil, fmt.Errorf("qpdf: %w", err)
+	}
+	if len(doc.Qpdf) != 2 {
+		return nil, nil, errors.New("qpdf: unexpected json output")
+	}
+	var header map[string]any
+	var objs map[string]qpdfObject
+	if err := json.Unmarshal(doc.Qpdf[0], &header); err != nil {
+		return nil, nil, fmt.Errorf("qpdf: %w", err)
+	}
+	if err := json.Unmarshal(doc.Qpdf[1], &objs); err != nil {
+		return nil, nil, fmt.Errorf("qpdf: %w", err)
+	}
+	return header, objs, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits request rate of each client with a token bucket, and
+// caps number of bytes and pages of documents produced for each client per
+// UTC day. Clients are identified by handler.clientKey.
+type rateLimiter struct {
+	rate      float64 // requests per second, unlimited if 0
+	burst     float64 // bucket capacity
+	quota     int64   // bytes per day, unlimited if 0
+	pageQuota int64   // pages per day, unlimited if 0
+
+	mu        sync.Mutex
+	clients   map[string]*clientUsage
+	lastSweep time.Time
+}
+
+type clientUsage struct {
+	tokens float64   // tokens left in the bucket
+	last   time.Time // when tokens were last updated
+	day    time.Time // UTC day used bytes and pages are counted for
+	used   int64     // bytes produced during day
+	pages  int64     // pages produced during day
+}
+
+func newRateLimiter(rate float64, burst int, quota, pageQuota int64) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), quota: quota,
+		pageQuota: pageQuota, clients: make(map[string]*clientUsage)}
+}
+
+// setLimits changes limits of l
+func (l *rateLimiter) setLimits(rate float64, burst int, quota, pageQuota int64) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst, l.quota, l.pageQuota = rate, float64(burst), quota, pageQuota
+}
+
+// allow reports whether client identified by key may make a request now. If
+// not, it also returns how long client should wait before retrying.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	c := l.usage(key, now)
+	if (l.quota > 0 && c.used >= l.quota) || (l.pageQuota > 0 && c.pages >= l.pageQuota) {
+		return false, c.day.AddDate(0, 0, 1).Sub(now)
+	}
+	if l.rate <= 0 {
+		return true, 0
+	}
+	if c.tokens < 1 {
+		return false, time.Duration((1 - c.tokens) / l.rate * float64(time.Second))
+	}
+	c.tokens--
+	return true, 0
+}
+
+// account adds n bytes and given number of pages of produced documents to
+// the daily usage of client identified by key.
+func (l *rateLimiter) account(key string, n int64, pages int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.quota > 0 || l.pageQuota > 0 {
+		c := l.usage(key, time.Now())
+		c.used += n
+		c.pages += int64(pages)
+	}
+}
+
+// countPages returns number of pages of PDF document f if l has a page
+// quota, or 0 if it has none or if pages can't be counted
+func (l *rateLimiter) countPages(ctx context.Context, f *os.File) int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	counts := l.pageQuota > 0
+	l.mu.Unlock()
+	if !counts {
+		return 0
+	}
+	n, _ := countPages(ctx, f)
+	return n
+}
+
+// usage returns client usage with bucket refilled and daily counter reset
+// according to current time. It must be called with l.mu held.
+func (l *rateLimiter) usage(key string, now time.Time) *clientUsage {
+	day := now.UTC().Truncate(24 * time.Hour)
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientUsage{tokens: l.burst, last: now, day: day}
+		l.clients[key] = c
+	}
+	c.tokens = math.Min(l.burst, c.tokens+now.Sub(c.last).Seconds()*l.rate)
+	c.last = now
+	if !c.day.Equal(day) {
+		c.day, c.used = day, 0
+	}
+	return c
+}
+
+// sweep removes clients with full buckets and nothing produced today, so that
+// map does not grow unbounded. It must be called with l.mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	day := now.UTC().Truncate(24 * time.Hour)
+	for k, c := range l.clients {
+		full := l.rate <= 0 || c.tokens+now.Sub(c.last).Seconds()*l.rate >= l.burst
+		if full && ((c.used == 0 && c.pages == 0) || !c.day.Equal(day)) {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// limit wraps next handler, replying with 429 Too Many Requests and
+// Retry-After header to clients exceeding their rate or daily quota.
+func (l *rateLimiter) limit(h *handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(h.clientKey(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			h.error(w, http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(1, 2, 0, 0)
+	for i := range 2 {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d within burst is not allowed", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("request over burst is allowed")
+	}
+	if wait != time.Second {
+		t.Errorf("got wait %v, want %v", wait, time.Second)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("other client is not allowed")
+	}
+	if ok, _ := l.allow("a", now.Add(time.Second)); !ok {
+		t.Error("request after refill is not allowed")
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		bytes, pages int64 // quotas
+		n            int64 // bytes per document
+		p            int   // pages per document
+	}{
+		{"bytes", 100, 0, 60, 1},
+		{"pages", 0, 5, 1, 3},
+		{"both, bytes hit", 100, 50, 60, 1},
+		{"both, pages hit", 1000, 5, 1, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			l := newRateLimiter(0, 1, tc.bytes, tc.pages)
+			for i := range 2 {
+				if ok, _ := l.allow("a", now); !ok {
+					t.Fatalf("request %d within quota is not allowed", i)
+				}
+				l.account("a", tc.n, tc.p)
+			}
+			ok, wait := l.allow("a", now)
+			if ok {
+				t.Fatal("request over quota is allowed")
+			}
+			next := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+			if want := next.Sub(now); wait != want {
+				t.Errorf("got wait %v, want %v until the next day", wait, want)
+			}
+			if ok, _ := l.allow("b", now); !ok {
+				t.Error("other client is not allowed")
+			}
+			if ok, _ := l.allow("a", next); !ok {
+				t.Error("request on the next day is not allowed")
+			}
+		})
+	}
+}
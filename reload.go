@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/artyom/autoflags"
+)
+
+// policy holds handler settings that can be changed without restart, see
+// handler.reload. It's replaced as a whole, so requests never see a mix of
+// old and new settings.
+type policy struct {
+	d          time.Duration // conversion timeout
+	perKB      time.Duration // increase d by this much per KiB of input
+	maxTimeout time.Duration // upper bound of d increased by perKB
+	urlTimeout time.Duration // conversion timeout for documents at /url
+	maxJSDelay time.Duration // upper bound of X-Pdf-Javascript-Delay
+	allowJS    bool          // whether X-Pdf-Javascript: true is honored
+
+	lenient   bool // accept PDF output of renderer exiting with non-zero code
+	linearize bool // linearize documents unless request sets X-Pdf-Linearize
+
+	token         string              // accepted Bearer token, if set
+	hashes        []tokenHash         // hashes of accepted Bearer tokens
+	tokenPriority map[string]priority // default request priority per token name
+
+	allowedNets    netList // networks allowed to use the service, any if nil
+	trustedProxies netList // proxies trusted to set X-Forwarded-For
+
+	allowedOptions   map[string]bool // X-Pdf-* headers to honor, all if nil
+	rejectDisallowed bool            // reply with 400 on headers not in allowedOptions
+
+	allowSink bool            // whether X-Pdf-Sink is honored
+	sinkHosts map[string]bool // hosts allowed in X-Pdf-Sink, any if nil
+
+	callbackHosts map[string]bool // hosts allowed in X-Pdf-Callback, none if nil
+
+	filename string      // pattern for Content-Disposition filename, see docFilename
+	headers  http.Header // extra headers set on successful replies
+}
+
+// newPolicy returns policy configured by args
+func newPolicy(args *cmdArgs) (*policy, error) {
+	p := &policy{
+		d: args.Timeout, perKB: args.PerKB, maxTimeout: args.MaxD,
+		urlTimeout: args.URLTime, maxJSDelay: args.JSDelay, allowJS: args.AllowJS,
+		lenient: args.Lenient, linearize: args.Linear, token: args.Token,
+		allowedNets: args.AllowNet, trustedProxies: args.Proxies,
+		allowedOptions:   commaSet(args.Options, http.CanonicalHeaderKey),
+		rejectDisallowed: args.Strict,
+		allowSink:        args.Sink, sinkHosts: commaSet(args.Sinks, strings.ToLower),
+		callbackHosts: commaSet(args.CBHosts, strings.ToLower),
+		headers:       http.Header(args.Headers),
+	}
+	if err := checkFilenamePattern(args.Fname); err != nil {
+		return nil, err
+	}
+	p.filename = args.Fname
+	var err error
+	if args.Hashes != "" {
+		if p.hashes, err = readTokenHashes(args.Hashes); err != nil {
+			return nil, err
+		}
+	}
+	if p.tokenPriority, err = parsePriorityMap(args.TokPrio); err != nil {
+		return nil, fmt.Errorf("-token-priority: %w", err)
+	}
+	return p, nil
+}
+
+// addHeaders adds extra headers to a successful reply, keeping values already
+// set, i.e. Vary set by compressor. Values are copied, as reply headers may be
+// changed later.
+func (p *policy) addHeaders(hdr http.Header) {
+	for k, v := range p.headers {
+		hdr[k] = append(hdr[k], v...)
+	}
+}
+
+// reloadableFlags are flags whose changes are applied by handler.reload;
+// changes of other flags require restart
+var reloadableFlags = map[string]bool{
+	"config": true, "q": true, "n": true, "max-queue": true, "max-queue-wait": true,
+	"d": true, "timeout-per-kb": true, "max-timeout": true, "url-timeout": true, "max-js-delay": true,
+	"allow-javascript": true, "tolerate-warnings": true, "linearize": true,
+	"token": true, "token-hash-file": true, "token-priority": true,
+	"allow-cidr": true, "trusted-proxies": true,
+	"allowed-options": true, "reject-disallowed": true,
+	"allow-sink": true, "sink-hosts": true, "callback-hosts": true,
+	"filename": true, "response-header": true,
+	"token-rate": true, "token-burst": true, "token-daily-bytes": true,
+	"token-daily-pages": true,
+}
+
+// loadArgs parses command line flags along with the configuration file and
+// environment, the same way they're parsed on startup. It also returns text
+// form of all flag values.
+func loadArgs() (*cmdArgs, map[string]string, error) {
+	args := defaultArgs()
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	autoflags.DefineFlagSet(fs, args)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, nil, err
+	}
+	if err := applyConfig(fs); err != nil {
+		return nil, nil, err
+	}
+	return args, flagValues(fs), nil
+}
+
+// flagValues returns text form of values of all flags from fs
+func flagValues(fs *flag.FlagSet) map[string]string {
+	m := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { m[f.Name] = f.Value.String() })
+	return m
+}
+
+// reload re-reads configuration and applies changes of reloadable flags. If
+// configuration has errors, none of them is applied. Token file and templates
+// are reloaded too, each is kept as is if it fails to load.
+func (h *handler) reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	args, values, err := loadArgs()
+	if err != nil {
+		return err
+	}
+	p, err := newPolicy(args)
+	if err != nil {
+		return err
+	}
+	for name, v := range values {
+		if !reloadableFlags[name] && v != h.flags[name] {
+			slog.Warn("flag change requires restart", "flag", name)
+		}
+	}
+	if v := values["n"]; v != h.flags["n"] {
+		if h.tuner != nil {
+			slog.Warn("flag change requires restart", "flag", "n")
+		} else {
+			h.gate.resize(max(args.Procs, 1))
+		}
+	}
+	h.gate.setQueueLimits(args.MaxQueue, args.MaxWait)
+	if h.limiter != nil {
+		h.limiter.setLimits(args.Rate, args.Burst, int64(args.Quota), int64(args.PageQ))
+	} else if args.Rate > 0 || args.Quota > 0 || args.PageQ > 0 {
+		slog.Warn("enabling rate limits requires restart")
+	}
+	h.noisy.Store(!args.Quiet)
+	h.policy.Store(p)
+	// values of other flags are still the ones process started with
+	for name := range reloadableFlags {
+		h.flags[name] = values[name]
+	}
+	var errs []error
+	if h.tokens != nil {
+		errs = append(errs, h.tokens.reload())
+	}
+	if h.templates != nil {
+		errs = append(errs, h.templates.reload())
+	}
+	return errors.Join(errs...)
+}
+
+// serveReload handles POST /-/reload requests at the admin address, doing the
+// same as SIGHUP
+func (h *handler) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.reload(); err != nil {
+		slog.Error("reload failed", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("configuration reloaded")
+	w.WriteHeader(http.StatusNoContent)
+}
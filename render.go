@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// renderer converts documents to PDF by running an external command
+type renderer interface {
+	// render converts src according to opts, writing PDF document to w and
+	// command diagnostic output to stderr. It returns state of the finished
+	// process, which may be nil if process failed to start.
+	render(ctx context.Context, src source, opts options, w, stderr io.Writer) (*os.ProcessState, error)
+	// command returns name of the external command renderer runs
+	command() string
+}
+
+// errUnsupported is returned by renderers on options they cannot apply
+var errUnsupported = errors.New("options not supported by renderer")
+
+// newRenderer returns renderer for the named engine
+func newRenderer(engine string, cfg renderConfig) (renderer, error) {
+	switch engine {
+	case "weasyprint":
+		return weasyPrint{cfg}, nil
+	case "chromium":
+		return chromium{cfg}, nil
+	}
+	return nil, fmt.Errorf("unsupported engine: %q", engine)
+}
+
+// renderConfig holds settings common to all renderers
+type renderConfig struct {
+	proxy   string     // if set, fetch external resources through this proxy url
+	sandbox *sandbox   // if not nil, run renderer command inside it
+	limits  procLimits // resource limits of renderer command
+
+	path      string   // renderer executable, overrides command name if set
+	extraArgs []string // extra arguments renderer is run with
+}
+
+// withProxy returns copy of c fetching resources through proxy url. Proxy
+// listens on the host network, so sandbox of the copy has network access.
+func (c renderConfig) withProxy(url string) renderConfig {
+	c.proxy = url
+	if c.sandbox != nil && !c.sandbox.network {
+		sb := *c.sandbox
+		sb.network = true
+		c.sandbox = &sb
+	}
+	return c
+}
+
+// commandOr returns executable configured with path, or name if it's not set
+func (c renderConfig) commandOr(name string) string {
+	if c.path != "" {
+		return c.path
+	}
+	return name
+}
+
+// renderCommand is like exec.CommandContext, but applies resource limits to
+// the command and runs it inside the sandbox, where it can only access
+// temporary files and directories listed in binds
+func (c renderConfig) renderCommand(ctx context.Context, binds []string, name string, args ...string) *exec.Cmd {
+	if !c.limits.empty() {
+		args = append(append(c.limits.args(), "--", name), args...)
+		name = "prlimit"
+	}
+	cmd := c.sandbox.command(ctx, binds, name, args...)
+	cmd.Env = rendererEnv("")
+	return cmd
+}
+
+// srcBinds returns paths renderer needs to access to read src: directory of
+// the source file, which holds its assets, if there are any
+func srcBinds(src source) []string {
+	if src.file == "" {
+		return nil
+	}
+	return []string{filepath.Dir(src.file)}
+}
+
+// weasyPrint renders documents with WeasyPrint
+type weasyPrint struct{ renderConfig }
+
+func (wp weasyPrint) command() string { return wp.commandOr("weasyprint") }
+
+func (wp weasyPrint) render(ctx context.Context, src source, opts options, w, stderr io.Writer) (*os.ProcessState, error) {
+	var args []string
+	binds := srcBinds(src)
+	if css := opts.stylesheet(); css != "" {
+		f, err := os.CreateTemp("", "pdfsvc-*.css")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(css)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--stylesheet", f.Name())
+		binds = append(binds, f.Name())
+	}
+	if opts.jsDelay > 0 || opts.screenshot {
+		// weasyprint never runs scripts and only produces PDF documents
+		return nil, errUnsupported
+	}
+	args = append(args, wp.extraArgs...)
+	switch {
+	case src.url != "":
+		args = append(args, src.url, "-")
+	case src.file != "":
+		args = append(args, src.file, "-")
+	default:
+		args = append(args, "--encoding", "utf8", "-", "-")
+	}
+	cmd := wp.renderCommand(ctx, binds, wp.command(), args...)
+	if wp.proxy != "" {
+		cmd.Env = rendererEnv(wp.proxy)
+	}
+	cmd.Stdin = src.r
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	return cmd.ProcessState, err
+}
+
+// chromium renders documents with headless Chromium. As Chromium can neither
+// read documents from stdin nor write them to stdout, it works with temporary
+// files.
+type chromium struct{ renderConfig }
+
+func (c chromium) command() string { return c.commandOr("chromium") }
+
+func (c chromium) render(ctx context.Context, src source, opts options, w, stderr io.Writer) (*os.ProcessState, error) {
+	css := opts.stylesheet()
+	switch {
+	case src.url != "":
+		if css != "" {
+			// there's no way to inject stylesheet into a remote document
+			return nil, errUnsupported
+		}
+	case src.file != "":
+		if css != "" {
+			if err := injectStyleFile(src.file, css); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		// request bodies are converted to utf-8, but Chromium reading them
+		// from file would still follow their original charset declaration
+		r, err := utf8Document(src.r, css)
+		if err != nil {
+			return nil, err
+		}
+		src.r = r
+	}
+	dir, err := os.MkdirTemp("", "pdfsvc-chromium-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	var input string
+	switch {
+	case src.url != "":
+		input = src.url
+	case src.file != "":
+		input = "file://" + src.file
+	default:
+		name := filepath.Join(dir, "input.html")
+		if err := writeFile(name, src.r); err != nil {
+			return nil, err
+		}
+		input = "file://" + name
+	}
+	args := []string{
+		"--headless",
+		"--disable-gpu",
+		// chromium always runs inside bwrap, where its own sandbox cannot
+		// set up namespaces
+		"--no-sandbox",
+		"--user-data-dir=" + filepath.Join(dir, "profile"),
+	}
+	var output string
+	if opts.screenshot {
+		output = filepath.Join(dir, "output.png")
+		vp := opts.window.orDefault()
+		args = append(args, "--screenshot="+output, "--hide-scrollbars",
+			"--window-size="+strconv.Itoa(vp.width)+","+strconv.Itoa(vp.height))
+	} else {
+		output = filepath.Join(dir, "output.pdf")
+		args = append(args, "--no-pdf-header-footer", "--print-to-pdf="+output)
+	}
+	if c.proxy != "" {
+		// loopback addresses bypass proxy by default
+		args = append(args, "--proxy-server="+c.proxy, "--proxy-bypass-list=<-loopback>")
+	}
+	switch {
+	case !opts.js:
+		args = append(args, "--blink-settings=scriptEnabled=false")
+	case opts.jsDelay > 0:
+		// virtual time advances as fast as page allows, so scripts waiting
+		// on timers and animations finish before capture
+		args = append(args, "--virtual-time-budget="+strconv.FormatInt(opts.jsDelay.Milliseconds(), 10))
+	}
+	args = append(args, c.extraArgs...)
+	cmd := c.renderCommand(ctx, append(srcBinds(src), dir), c.command(), append(args, input)...)
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+	// Chromium spawns helper processes, make sure they're all killed on
+	// timeout and don't keep output pipes open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		return cmd.ProcessState, err
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return cmd.ProcessState, err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return cmd.ProcessState, err
+}
+
+// secretEnv are environment variables holding service secrets; they're not
+// passed to renderers, as documents could read them from /proc/self/environ
+var secretEnv = map[string]bool{
+	"TOKEN": true, "JWT_SECRET": true, "SIGNING_SECRET": true, "CALLBACK_SECRET": true,
+}
+
+// rendererEnv returns environment of the current process without secrets.
+// If proxy is set, proxy variables are replaced to make commands use proxy
+// url.
+func rendererEnv(proxy string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if secretEnv[k] {
+			continue
+		}
+		switch strings.ToLower(k) {
+		case "http_proxy", "https_proxy", "all_proxy", "no_proxy":
+			if proxy != "" {
+				continue
+			}
+		}
+		env = append(env, kv)
+	}
+	if proxy != "" {
+		env = append(env, "http_proxy="+proxy, "https_proxy="+proxy)
+	}
+	return env
+}
+
+// writeFile writes contents of r to a newly created file
+func writeFile(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
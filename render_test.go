@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRenderConfigWithProxy(t *testing.T) {
+	cfg := renderConfig{sandbox: &sandbox{readOnly: []string{"/srv/fonts"}}}
+	ucfg := cfg.withProxy("http://127.0.0.1:8081")
+	if ucfg.proxy != "http://127.0.0.1:8081" {
+		t.Errorf("got proxy %q", ucfg.proxy)
+	}
+	if !ucfg.sandbox.network {
+		t.Error("sandbox of proxied renderer has no network")
+	}
+	if cfg.sandbox.network {
+		t.Error("sandbox of the original config got network")
+	}
+	if !slices.Equal(ucfg.sandbox.readOnly, cfg.sandbox.readOnly) {
+		t.Errorf("got read-only paths %q, want %q", ucfg.sandbox.readOnly, cfg.sandbox.readOnly)
+	}
+	for _, tc := range []struct {
+		c    renderConfig
+		want bool
+	}{
+		{cfg, false},
+		{ucfg, true},
+	} {
+		cmd := tc.c.sandbox.command(context.Background(), nil, "weasyprint")
+		if got := slices.Contains(cmd.Args, "--share-net"); got != tc.want {
+			t.Errorf("network %v: got --share-net %v in %q", tc.c.sandbox.network, got, cmd.Args)
+		}
+	}
+	if c := (renderConfig{}).withProxy("http://127.0.0.1:8081"); c.sandbox != nil {
+		t.Error("unsandboxed renderer got a sandbox")
+	}
+}
+
+func TestChromiumCharset(t *testing.T) {
+	// fake chromium saves the document it's given and writes an empty PDF
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.html")
+	script := filepath.Join(dir, "chromium")
+	err := os.WriteFile(script, []byte("#!/bin/sh\nfor a; do case $a in\n"+
+		"--print-to-pdf=*) out=${a#--print-to-pdf=};;\n"+
+		"file://*) cp \"${a#file://}\" "+input+";;\nesac; done\n"+
+		"printf '%%PDF-1.7\\n' >\"$out\"\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, "", nil)
+	h.renderer = chromium{renderConfig{path: script}}
+	// "Привет" in windows-1251
+	doc := "<html><head><meta http-equiv=Content-Type content=\"text/html; charset=windows-1251\">" +
+		"<meta charset=windows-1251><title>\xcf\xf0\xe8\xe2\xe5\xf2</title></head><body></body></html>"
+	r := httptest.NewRequest("POST", "/", strings.NewReader(doc))
+	r.Header.Set("Content-Type", "text/html; charset=windows-1251")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	b, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<html><head><meta charset="utf-8"/><title>Привет</title></head><body></body></html>`
+	if string(b) != want {
+		t.Errorf("chromium got document %q, want %q", b, want)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// procLimits are resource limits applied to renderer processes with
+// prlimit(1), zero values mean no limit
+type procLimits struct {
+	memory uint64        // max size of process data segment, in bytes
+	cpu    time.Duration // max CPU time
+	output uint64        // max size of files written, in bytes
+}
+
+var (
+	errOutputLimit = errors.New("renderer exceeded output size limit")
+	errCPULimit    = errors.New("renderer exceeded CPU time limit")
+	errMemoryLimit = errors.New("renderer exceeded memory limit")
+)
+
+func (l procLimits) empty() bool { return l == procLimits{} }
+
+// args returns prlimit command line options setting limits
+func (l procLimits) args() []string {
+	var args []string
+	if l.memory > 0 {
+		args = append(args, "--data="+strconv.FormatUint(l.memory, 10))
+	}
+	if l.cpu > 0 {
+		// process gets SIGXCPU on soft limit, and SIGKILL a second later
+		// on hard one
+		secs := int64((l.cpu + time.Second - 1) / time.Second)
+		args = append(args, "--cpu="+strconv.FormatInt(secs, 10)+":"+strconv.FormatInt(secs+1, 10))
+	}
+	if l.output > 0 {
+		args = append(args, "--fsize="+strconv.FormatUint(l.output, 10))
+	}
+	return args
+}
+
+// exceeded returns error describing the limit renderer process finished with
+// ps and stderr output most likely exceeded, or nil if there's none
+func (l procLimits) exceeded(ps *os.ProcessState, stderr []byte) error {
+	if ps == nil || l.empty() {
+		return nil
+	}
+	sig := exitSignal(ps)
+	switch {
+	case sig == syscall.SIGXFSZ && l.output > 0:
+		return errOutputLimit
+	case l.cpu > 0 && (sig == syscall.SIGXCPU || sig == syscall.SIGKILL && ps.UserTime()+ps.SystemTime() >= l.cpu):
+		return errCPULimit
+	case l.memory > 0 && bytes.Contains(stderr, []byte("MemoryError")):
+		// weasyprint runs out of memory
+		return errMemoryLimit
+	case l.memory > 0 && (sig == syscall.SIGSEGV || sig == syscall.SIGABRT || sig == syscall.SIGTRAP):
+		// Chromium crashes on failed allocations
+		return errMemoryLimit
+	}
+	return nil
+}
+
+// exitSignal returns signal that killed process finished with ps, or 0 if it
+// exited normally
+func exitSignal(ps *os.ProcessState) syscall.Signal {
+	if ps == nil {
+		return 0
+	}
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	switch {
+	case !ok:
+		return 0
+	case ws.Signaled():
+		return ws.Signal()
+	case ws.ExitStatus() > 128:
+		// bwrap reports child killed by a signal this way
+		return syscall.Signal(ws.ExitStatus() - 128)
+	}
+	return 0
+}
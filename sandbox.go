@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// sandbox runs commands with bubblewrap in their own namespaces, with
+// read-only view of system directories, and with no network unless it's
+// allowed. Temporary directory is replaced with an empty one, where only
+// paths given to command are visible, so that renderers cannot reach files
+// of other requests. nil sandbox runs commands as is.
+type sandbox struct {
+	network  bool
+	readOnly []string // extra paths every command may read, i.e. fonts
+}
+
+// systemPaths are parts of the filesystem visible in the sandbox: renderers
+// need programs, libraries and some of configuration to run, but documents
+// must not read the rest of /etc, home directories or service secrets with
+// file:// urls
+var systemPaths = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/opt", "/sys",
+	"/etc/alternatives", "/etc/ld.so.cache", "/etc/ld.so.conf", "/etc/ld.so.conf.d",
+	"/etc/fonts", "/etc/ssl/certs", "/etc/ssl/cert.pem", "/etc/ssl/openssl.cnf",
+	"/etc/ca-certificates", "/etc/pki/ca-trust", "/etc/pki/tls/certs",
+	"/etc/localtime", "/etc/hosts", "/etc/resolv.conf", "/etc/nsswitch.conf",
+	"/etc/passwd", "/etc/group", "/etc/mime.types",
+	"/etc/chromium", "/etc/chromium.d", "/etc/libreoffice",
+	"/var/cache/fontconfig",
+}
+
+// command is like exec.CommandContext, but runs command inside the sandbox,
+// with binds paths visible and writable
+func (s *sandbox) command(ctx context.Context, binds []string, name string, args ...string) *exec.Cmd {
+	if s == nil {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	tmp, err := filepath.EvalSymlinks(os.TempDir())
+	if err != nil {
+		tmp = os.TempDir()
+	}
+	var bwArgs []string
+	for _, p := range systemPaths {
+		// merged /usr systems have /bin -> usr/bin and such
+		if target, err := os.Readlink(p); err == nil && !filepath.IsAbs(target) {
+			bwArgs = append(bwArgs, "--symlink", target, p)
+			continue
+		}
+		bwArgs = append(bwArgs, "--ro-bind-try", p, p)
+	}
+	bwArgs = append(bwArgs,
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", tmp,
+		"--setenv", "HOME", tmp,
+	)
+	for _, p := range s.readOnly {
+		bwArgs = append(bwArgs, "--ro-bind-try", p, p)
+	}
+	for _, p := range binds {
+		bwArgs = append(bwArgs, "--bind", p, p)
+	}
+	bwArgs = append(bwArgs,
+		"--remount-ro", "/",
+		// new pid namespace also makes sure all processes are killed along
+		// with bwrap on timeout
+		"--unshare-all",
+		"--die-with-parent",
+		"--new-session",
+	)
+	if s.network {
+		bwArgs = append(bwArgs, "--share-net")
+	}
+	bwArgs = append(bwArgs, "--", name)
+	return exec.CommandContext(ctx, "bwrap", append(bwArgs, args...)...)
+}
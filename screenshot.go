@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// viewport is size of browser window in CSS pixels
+type viewport struct{ width, height int }
+
+// defaultViewport is window size of screenshots not setting X-Pdf-Window-Size
+var defaultViewport = viewport{1280, 800}
+
+// maxViewportSide limits width and height of screenshots
+const maxViewportSide = 4096
+
+var viewportSize = regexp.MustCompile(`^([0-9]{1,4})x([0-9]{1,4})$`)
+
+// parseViewport parses window size given as WIDTHxHEIGHT, i.e. 1280x800. It
+// returns zero viewport if s is empty.
+func parseViewport(s string) (viewport, error) {
+	if s == "" {
+		return viewport{}, nil
+	}
+	m := viewportSize.FindStringSubmatch(s)
+	if m == nil {
+		return viewport{}, fmt.Errorf("invalid window size %q", s)
+	}
+	var vp viewport
+	vp.width, _ = strconv.Atoi(m[1])
+	vp.height, _ = strconv.Atoi(m[2])
+	if vp.width == 0 || vp.height == 0 || vp.width > maxViewportSide || vp.height > maxViewportSide {
+		return viewport{}, fmt.Errorf("window size %q is out of range", s)
+	}
+	return vp, nil
+}
+
+// defaultJPEGQuality is quality of JPEG images not setting X-Pdf-Image-Quality
+const defaultJPEGQuality = 85
+
+// parseImageFormat parses X-Pdf-Image-Format and X-Pdf-Image-Quality headers,
+// reporting whether JPEG image is requested and its quality. Quality is only
+// allowed with JPEG format.
+func parseImageFormat(hdr http.Header) (bool, int, error) {
+	var isJPEG bool
+	switch s := strings.ToLower(hdr.Get("X-Pdf-Image-Format")); s {
+	case "", "png":
+	case "jpeg", "jpg":
+		isJPEG = true
+	default:
+		return false, 0, fmt.Errorf("unsupported image format %q", s)
+	}
+	var quality int
+	if s := hdr.Get("X-Pdf-Image-Quality"); s != "" {
+		var err error
+		if quality, err = strconv.Atoi(s); err != nil || !isJPEG || quality < 1 || quality > 100 {
+			return false, 0, fmt.Errorf("invalid image quality %q", s)
+		}
+	}
+	return isJPEG, quality, nil
+}
+
+// orDefault returns vp, or defaultViewport if vp is not set
+func (vp viewport) orDefault() viewport {
+	if vp == (viewport{}) {
+		return defaultViewport
+	}
+	return vp
+}
+
+// serveScreenshot handles requests to /image: html document from request
+// body is rendered in a browser window of X-Pdf-Window-Size and replied with
+// as a PNG image of the window, or JPEG one if X-Pdf-Image-Format asks for
+// it. Only chromium renderer can capture images, options only applying to
+// PDF documents are ignored.
+func (h *handler) serveScreenshot(w http.ResponseWriter, r *http.Request) {
+	if !h.accept(w, r) {
+		return
+	}
+	src, ok := h.htmlSource(w, r)
+	if !ok {
+		return
+	}
+	opts, err := h.requestOptions(r)
+	if err != nil || opts.sink != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	opts.screenshot = true
+	res, err := h.render(r.Context(), src, opts)
+	if err != nil {
+		h.conversionError(w, err)
+		return
+	}
+	defer res.Close()
+	var img io.ReadSeeker = res
+	contentType := "image/png"
+	if opts.jpeg {
+		b, err := pngToJPEG(res, opts.quality)
+		if err != nil {
+			ctxLogger(r.Context()).Error("encoding JPEG image failed", "error", err)
+			h.error(w, http.StatusInternalServerError)
+			return
+		}
+		img, contentType = bytes.NewReader(b), "image/jpeg"
+	}
+	if size, err := img.Seek(0, io.SeekEnd); err == nil {
+		h.limiter.account(h.clientKey(r), size, 0)
+	}
+	h.policy.Load().addHeaders(w.Header())
+	w.Header().Set("X-Pdf-Render-Time", res.rendered.String())
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.Now(), img)
+}
+
+// pngToJPEG re-encodes PNG image read from r as JPEG of given quality, or of
+// defaultJPEGQuality if it's 0. Chromium can only save screenshots as PNG.
+func pngToJPEG(r io.Reader, quality int) ([]byte, error) {
+	img, err := png.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if quality == 0 {
+		quality = defaultJPEGQuality
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
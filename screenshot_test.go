@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseViewport(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    viewport
+		wantErr bool
+	}{
+		{in: ""},
+		{in: "800x600", want: viewport{800, 600}},
+		{in: "4096x4096", want: viewport{4096, 4096}},
+		{in: "4097x600", wantErr: true},
+		{in: "0x600", wantErr: true},
+		{in: "800", wantErr: true},
+		{in: "800x600x1", wantErr: true},
+		{in: "-800x600", wantErr: true},
+	} {
+		got, err := parseViewport(tc.in)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("parseViewport(%q) = %v, want error", tc.in, got)
+		case !tc.wantErr && err != nil:
+			t.Errorf("parseViewport(%q): %v", tc.in, err)
+		case got != tc.want:
+			t.Errorf("parseViewport(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestScreenshotUnsupported(t *testing.T) {
+	h := newTestHandler(t, "cat >/dev/null; printf '%%PDF-1.7\\n'", nil)
+	_, err := h.render(context.Background(), source{r: strings.NewReader("<p>hi")}, options{screenshot: true})
+	if !errors.Is(err, errUnsupported) {
+		t.Errorf("got error %v, want %v", err, errUnsupported)
+	}
+}
+
+func TestParseImageFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format, quality string
+		jpeg            bool
+		want            int
+		wantErr         bool
+	}{
+		{},
+		{format: "png"},
+		{format: "JPEG", jpeg: true},
+		{format: "jpg", quality: "60", jpeg: true, want: 60},
+		{format: "gif", wantErr: true},
+		{format: "png", quality: "60", wantErr: true},
+		{format: "jpeg", quality: "0", wantErr: true},
+		{format: "jpeg", quality: "101", wantErr: true},
+		{format: "jpeg", quality: "high", wantErr: true},
+	} {
+		hdr := http.Header{}
+		if tc.format != "" {
+			hdr.Set("X-Pdf-Image-Format", tc.format)
+		}
+		if tc.quality != "" {
+			hdr.Set("X-Pdf-Image-Quality", tc.quality)
+		}
+		isJPEG, quality, err := parseImageFormat(hdr)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("%q, %q: got no error", tc.format, tc.quality)
+		case !tc.wantErr && err != nil:
+			t.Errorf("%q, %q: %v", tc.format, tc.quality, err)
+		case isJPEG != tc.jpeg || quality != tc.want:
+			t.Errorf("%q, %q: got %v, %d, want %v, %d", tc.format, tc.quality, isJPEG, quality, tc.jpeg, tc.want)
+		}
+	}
+}
+
+func TestServeScreenshot(t *testing.T) {
+	var png1 bytes.Buffer
+	if err := png.Encode(&png1, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "shot.png")
+	if err := os.WriteFile(src, png1.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// fake chromium copies the image to --screenshot path
+	h := newTestHandler(t, "", nil)
+	script := filepath.Join(t.TempDir(), "chromium")
+	err := os.WriteFile(script, []byte("#!/bin/sh\nfor a; do case $a in --screenshot=*) cp "+src+
+		" \"${a#--screenshot=}\";; esac; done\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.renderer = chromium{renderConfig{path: script}}
+	h.limiter = newRateLimiter(0, 1, 1<<20, 0)
+	for _, tc := range []struct {
+		format, contentType string
+		decode              func([]byte) error
+	}{
+		{"", "image/png", func(b []byte) error { _, err := png.Decode(bytes.NewReader(b)); return err }},
+		{"jpeg", "image/jpeg", func(b []byte) error { _, err := jpeg.Decode(bytes.NewReader(b)); return err }},
+	} {
+		t.Run(tc.contentType, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/image", strings.NewReader("<p>hi"))
+			r.Header.Set("Content-Type", "text/html")
+			if tc.format != "" {
+				r.Header.Set("X-Pdf-Image-Format", tc.format)
+			}
+			key := h.clientKey(r)
+			h.limiter.mu.Lock()
+			before := h.limiter.usage(key, time.Now()).used
+			h.limiter.mu.Unlock()
+			w := httptest.NewRecorder()
+			h.serveScreenshot(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.contentType {
+				t.Errorf("got Content-Type %q, want %q", got, tc.contentType)
+			}
+			if err := tc.decode(w.Body.Bytes()); err != nil {
+				t.Errorf("decoding reply: %v", err)
+			}
+			h.limiter.mu.Lock()
+			used := h.limiter.usage(key, time.Now()).used - before
+			h.limiter.mu.Unlock()
+			if used != int64(w.Body.Len()) {
+				t.Errorf("got %d bytes accounted, want %d", used, w.Body.Len())
+			}
+		})
+	}
+}
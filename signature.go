@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureWindow is max difference between signed request timestamp and
+// current time
+const signatureWindow = 5 * time.Minute
+
+// requestSigner verifies requests signed with a shared secret. Signature is
+// sent in X-Signature header in the following form:
+//
+//	t=<unix time>,sha256=<hex-encoded hmac>
+//
+// where hmac is HMAC-SHA256 of "<unix time>.<method>.<request uri>.<body>".
+// Each signature is only accepted once.
+type requestSigner struct {
+	secret []byte
+
+	mu     sync.Mutex
+	seen   map[string]time.Time // accepted signatures and their expiry times
+	pruned time.Time            // when expired signatures were last removed
+}
+
+func newRequestSigner(secret string) *requestSigner {
+	return &requestSigner{secret: []byte(secret), seen: make(map[string]time.Time)}
+}
+
+// verify checks request signature. Request body is read to compute the
+// signature, and replaced with an equivalent one.
+func (s *requestSigner) verify(r *http.Request, now time.Time) error {
+	var ts, sig string
+	for _, f := range strings.Split(r.Header.Get("X-Signature"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(f), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "sha256":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("invalid signature timestamp")
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > signatureWindow || d < -signatureWindow {
+		return errors.New("signature timestamp is out of window")
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil || len(want) != sha256.Size {
+		return errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	io.WriteString(mac, ts+"."+r.Method+"."+r.RequestURI+".")
+	if r.Body != nil {
+		// bodies are either files, or in-memory buffers that can be read
+		// only once, see buffering.Handler
+		if f, ok := r.Body.(io.ReadSeeker); ok {
+			if _, err := io.Copy(mac, f); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		} else {
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				return err
+			}
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			mac.Write(data)
+		}
+	}
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return errors.New("invalid signature")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.pruned) > time.Minute {
+		for k, exp := range s.seen {
+			if now.After(exp) {
+				delete(s.seen, k)
+			}
+		}
+		s.pruned = now
+	}
+	key := string(want)
+	if exp, ok := s.seen[key]; ok && !now.After(exp) {
+		return errors.New("signature already used")
+	}
+	// signatures older than the window are rejected by timestamp check, so
+	// there's no need to remember them any longer
+	s.seen[key] = time.Unix(unix, 0).Add(signatureWindow)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signRequest returns X-Signature header value for request signed at ts
+func signRequest(secret string, ts time.Time, method, uri, body string) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, t+"."+method+"."+uri+"."+body)
+	return "t=" + t + ",sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestRequestSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		name string
+		sig  string
+		ok   bool
+	}{
+		{"valid", signRequest("s3cret", now, "POST", "/?a=1", "<p>hi"), true},
+		{"within window", signRequest("s3cret", now.Add(-4*time.Minute), "POST", "/?a=1", "<p>hi"), true},
+		{"future within window", signRequest("s3cret", now.Add(4*time.Minute), "POST", "/?a=1", "<p>hi"), true},
+		{"too old", signRequest("s3cret", now.Add(-6*time.Minute), "POST", "/?a=1", "<p>hi"), false},
+		{"too far in future", signRequest("s3cret", now.Add(6*time.Minute), "POST", "/?a=1", "<p>hi"), false},
+		{"wrong secret", signRequest("other", now, "POST", "/?a=1", "<p>hi"), false},
+		{"wrong method", signRequest("s3cret", now, "PUT", "/?a=1", "<p>hi"), false},
+		{"wrong uri", signRequest("s3cret", now, "POST", "/?a=2", "<p>hi"), false},
+		{"wrong body", signRequest("s3cret", now, "POST", "/?a=1", "<p>bye"), false},
+		{"no timestamp", "sha256=" + strings.Repeat("00", sha256.Size), false},
+		{"malformed", "t=1700000000,sha256=zz", false},
+		{"missing", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newRequestSigner("s3cret")
+			r := httptest.NewRequest("POST", "/?a=1", strings.NewReader("<p>hi"))
+			r.Header.Set("X-Signature", tc.sig)
+			err := s.verify(r, now)
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// body is still readable after verification
+			if b, _ := io.ReadAll(r.Body); string(b) != "<p>hi" {
+				t.Errorf("got body %q after verification", b)
+			}
+		})
+	}
+}
+
+func TestRequestSignatureReplay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newRequestSigner("s3cret")
+	sig := signRequest("s3cret", now, "POST", "/", "<p>hi")
+	verify := func(at time.Time) error {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("<p>hi"))
+		r.Header.Set("X-Signature", sig)
+		return s.verify(r, at)
+	}
+	if err := verify(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(now.Add(time.Second)); err == nil {
+		t.Error("replayed signature is accepted")
+	}
+	// pruning of expired signatures must not forget ones still in window
+	if err := verify(now.Add(2 * time.Minute)); err == nil {
+		t.Error("replayed signature is accepted after pruning")
+	}
+	if err := verify(now.Add(signatureWindow + time.Second)); err == nil {
+		t.Error("signature is accepted after its window")
+	}
+	// other signatures are not affected
+	r := httptest.NewRequest("POST", "/", strings.NewReader("<p>hi"))
+	r.Header.Set("X-Signature", signRequest("s3cret", now.Add(time.Second), "POST", "/", "<p>hi"))
+	if err := s.verify(r, now.Add(time.Second)); err != nil {
+		t.Errorf("fresh signature: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// sinkClient is used to upload documents to sinks and to post job callbacks.
+// It does not follow redirects, so that host allowlists cannot be bypassed.
+var sinkClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// parseHTTPURL parses s as an absolute http or https url
+func parseHTTPURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("url must be http or https")
+	}
+	if u.Host == "" {
+		return nil, errors.New("url must have host")
+	}
+	return u, nil
+}
+
+// sinkAllowed reports whether documents may be uploaded to u
+func (h *handler) sinkAllowed(u *url.URL) bool {
+	p := h.policy.Load()
+	if !p.allowSink {
+		return false
+	}
+	return p.sinkHosts == nil || p.sinkHosts[strings.ToLower(u.Hostname())]
+}
+
+// upload streams document to sink url with a PUT request, returning number of
+// bytes uploaded.
+func upload(ctx context.Context, u *url.URL, doc io.ReadSeeker) (int64, error) {
+	size, err := doc.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := doc.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), io.NopCloser(doc))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/pdf")
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("sink replied with %s", resp.Status)
+	}
+	return size, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// serveSplit handles POST /split requests with html document bodies. The
+// document is converted, and the reply is a ZIP archive with a PDF document
+// per page of the result, or per page range listed in X-Pdf-Split header.
+func (h *handler) serveSplit(w http.ResponseWriter, r *http.Request) {
+	if !h.accept(w, r) {
+		return
+	}
+	opts, err := h.requestOptions(r)
+	// encrypted document cannot be split without its password
+	if err != nil || opts.sink != nil || opts.encrypt != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	src, ok := h.htmlSource(w, r)
+	if !ok {
+		return
+	}
+	res, err := h.convert(r.Context(), src, opts)
+	if err != nil {
+		h.conversionError(w, err)
+		return
+	}
+	defer res.Close()
+	l := ctxLogger(r.Context())
+	dir, err := os.MkdirTemp("", "pdfsvc-split-")
+	if err != nil {
+		l.Error("creating split directory failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	names, err := splitPDF(r.Context(), res.File, dir, opts.split)
+	if err != nil {
+		l.Info("split failed", "error", err)
+		h.conversionError(w, err)
+		return
+	}
+	h.policy.Load().addHeaders(w.Header())
+	if res.warning != "" {
+		w.Header().Set("X-Pdf-Warning", res.warning)
+	}
+	for _, s := range res.warnings {
+		w.Header().Add("X-Pdf-Warnings", s)
+	}
+	w.Header().Set("X-Pdf-Queue-Wait", res.queued.String())
+	w.Header().Set("X-Pdf-Render-Time", res.rendered.String())
+	w.Header().Set("Content-Type", "application/zip")
+	key := h.clientKey(r)
+	h.limiter.account(key, 0, h.limiter.countPages(r.Context(), res.File))
+	zw := zip.NewWriter(w)
+	now := time.Now()
+	for _, name := range names {
+		n, err := copyZipFile(zw, name, now)
+		if err != nil {
+			l.Info("writing split reply failed", "error", err)
+			return
+		}
+		h.limiter.account(key, n, 0)
+	}
+	if err := zw.Close(); err != nil {
+		l.Info("writing split reply failed", "error", err)
+	}
+}
+
+// splitPDF splits PDF document f into files in dir, one per page range, or
+// one per page if ranges is empty, and returns their names in order
+func splitPDF(ctx context.Context, f *os.File, dir string, ranges []string) ([]string, error) {
+	if len(ranges) != 0 {
+		n, err := countPages(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range ranges {
+			if lastPage(s) > n {
+				return nil, errPageRange
+			}
+		}
+	}
+	input := filepath.Join(dir, "input.pdf")
+	if err := writeFile(input, f); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		// qpdf replaces %d with zero-padded page numbers, so that file
+		// names sort in page order
+		if err := runQpdf(ctx, input, "--split-pages", filepath.Join(dir, "page-%d.pdf")); err != nil {
+			return nil, err
+		}
+		return filepath.Glob(filepath.Join(dir, "page-*.pdf"))
+	}
+	var names []string
+	for _, s := range ranges {
+		name := filepath.Join(dir, "pages-"+s+".pdf")
+		if err := runQpdf(ctx, input, "--pages", ".", s, "--", name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// copyZipFile adds named file to the archive under its base name, returning
+// number of bytes copied
+func copyZipFile(zw *zip.Writer, name string, modified time.Time) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: filepath.Base(name), Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, f)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// templateSuffix is a file name suffix of templates loaded by templateSet
+const templateSuffix = ".html.tmpl"
+
+// templateSet holds html templates loaded from a directory, keyed by file
+// names without templateSuffix.
+type templateSet struct {
+	dir string
+
+	mu sync.RWMutex
+	m  map[string]*template.Template
+}
+
+func loadTemplates(dir string) (*templateSet, error) {
+	ts := &templateSet{dir: dir}
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// reload parses all templates from the directory, replacing previously loaded
+// ones. On error, previously loaded templates are kept.
+func (ts *templateSet) reload() error {
+	names, err := filepath.Glob(filepath.Join(ts.dir, "*"+templateSuffix))
+	if err != nil {
+		return err
+	}
+	m := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		t, err := template.ParseFiles(name)
+		if err != nil {
+			return err
+		}
+		m[strings.TrimSuffix(filepath.Base(name), templateSuffix)] = t
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.m = m
+	return nil
+}
+
+func (ts *templateSet) lookup(name string) *template.Template {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.m[name]
+}
+
+// validTemplateName matches names of templates managed at /templates/
+var validTemplateName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// errTemplateSyntax is returned by put on templates failing to parse
+var errTemplateSyntax = errors.New("template syntax error")
+
+// put parses template source and saves it to the directory under a given
+// name, replacing existing template if there is one.
+func (ts *templateSet) put(name string, src []byte) error {
+	t, err := template.New(name + templateSuffix).Parse(string(src))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errTemplateSyntax, err)
+	}
+	f, err := os.CreateTemp(ts.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(src); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := os.Rename(f.Name(), filepath.Join(ts.dir, name+templateSuffix)); err != nil {
+		return err
+	}
+	ts.m[name] = t
+	return nil
+}
+
+// source returns source of the named template
+func (ts *templateSet) source(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(ts.dir, name+templateSuffix))
+}
+
+// remove deletes the named template
+func (ts *templateSet) remove(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := os.Remove(filepath.Join(ts.dir, name+templateSuffix)); err != nil {
+		return err
+	}
+	delete(ts.m, name)
+	return nil
+}
+
+// serveTemplates handles PUT, GET and DELETE requests to /templates/{name},
+// which upload, download and delete templates in templates directory.
+func (h *handler) serveTemplates(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAuth(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/templates/")
+	if !validTemplateName.MatchString(name) {
+		h.error(w, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		src, err := io.ReadAll(r.Body)
+		if err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+		if err := h.templates.put(name, src); err != nil {
+			if errors.Is(err, errTemplateSyntax) {
+				if h.noisy.Load() {
+					ctxLogger(r.Context()).Info("template parsing failed", "template", name, "error", err)
+				}
+				h.error(w, http.StatusBadRequest)
+				return
+			}
+			ctxLogger(r.Context()).Error("saving template failed", "template", name, "error", err)
+			h.error(w, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		src, err := h.templates.source(name)
+		if err != nil {
+			h.error(w, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(src)
+	case http.MethodDelete:
+		if err := h.templates.remove(name); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				h.error(w, http.StatusNotFound)
+				return
+			}
+			ctxLogger(r.Context()).Error("removing template failed", "template", name, "error", err)
+			h.error(w, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT, GET, HEAD, DELETE")
+		h.error(w, http.StatusMethodNotAllowed)
+	}
+}
+
+// serveRender handles requests to /render/{name}: request body is decoded as
+// JSON and used as data to execute named template, result is then converted
+// to PDF.
+func (h *handler) serveRender(w http.ResponseWriter, r *http.Request) {
+	if !h.accept(w, r) {
+		return
+	}
+	t := h.templates.lookup(strings.TrimPrefix(r.URL.Path, "/render/"))
+	if t == nil {
+		h.error(w, http.StatusNotFound)
+		return
+	}
+	var data any
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	h.serveTemplate(w, r, t, data)
+}
+
+// serveTemplateJSON handles requests with JSON bodies holding data to
+// execute a template with, and either the template itself, or a name of a
+// template loaded from templates directory:
+//
+//	{"template": "<p>Dear {{.name}}</p>", "data": {"name": "Jane Roe"}}
+//	{"name": "invoice", "data": {"customer": "Jane Roe"}}
+//
+// Result is then converted to PDF.
+func (h *handler) serveTemplateJSON(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Template string `json:"template"`
+		Name     string `json:"name"`
+		Data     any    `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	var t *template.Template
+	switch {
+	case req.Template != "" && req.Name == "":
+		var err error
+		if t, err = template.New("inline").Parse(req.Template); err != nil {
+			if h.noisy.Load() {
+				ctxLogger(r.Context()).Info("template parsing failed", "error", err)
+			}
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+	case req.Name != "" && req.Template == "":
+		if h.templates != nil {
+			t = h.templates.lookup(req.Name)
+		}
+		if t == nil {
+			h.error(w, http.StatusNotFound)
+			return
+		}
+	default:
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	h.serveTemplate(w, r, t, req.Data)
+}
+
+// serveTemplate executes template t with data and converts the result
+func (h *handler) serveTemplate(w http.ResponseWriter, r *http.Request, t *template.Template, data any) {
+	buf := &templateOutput{ctx: r.Context(), max: h.maxBody}
+	if err := t.Execute(buf, data); err != nil {
+		if err == errTemplateOutput {
+			h.error(w, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if h.noisy.Load() {
+			ctxLogger(r.Context()).Info("template execution failed", "template", t.Name(), "error", err)
+		}
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	h.serveConverted(w, r, source{r: &buf.buf})
+}
+
+var errTemplateOutput = errors.New("template output is too large")
+
+// templateOutput collects output of template execution. As templates may
+// loop for long, it's limited to max bytes, if set, and writes fail once
+// ctx is done.
+type templateOutput struct {
+	ctx context.Context
+	max int64
+	buf bytes.Buffer
+}
+
+func (o *templateOutput) Write(p []byte) (int, error) {
+	if err := o.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if o.max > 0 && int64(o.buf.Len()+len(p)) > o.max {
+		return 0, errTemplateOutput
+	}
+	return o.buf.Write(p)
+}
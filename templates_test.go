@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeTemplateOutputLimit(t *testing.T) {
+	h := newTestHandler(t, "cat >/dev/null; printf '%%PDF-1.7\\n'", nil)
+	h.maxBody = 1 << 10
+	for _, tc := range []struct {
+		name string
+		src  string
+		want int
+	}{
+		{"small", `<p>{{.}}</p>`, http.StatusOK},
+		{"large", `{{range 10000000}}<p>{{.}}</p>{{end}}`, http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl := template.Must(template.New("inline").Parse(tc.src))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/", nil)
+			h.serveTemplate(w, r, tmpl, "hello")
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestTemplateOutputCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tmpl := template.Must(template.New("inline").Parse(`{{range 10000000}}<p>x</p>{{end}}`))
+	out := &templateOutput{ctx: ctx}
+	if err := tmpl.Execute(out, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if out.buf.Len() != 0 {
+		t.Errorf("got %d bytes of output, want none", out.buf.Len())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/html/charset"
+)
+
+// textPage is an html document presenting plain text. Newline following the
+// <pre> tag is ignored by html parsers, so that leading newlines of the text
+// are kept.
+var textPage = template.Must(template.New("text").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><style>
+pre { margin: 0; font-family: monospace; font-size: {{.FontSize}}; white-space: {{.WhiteSpace}}; overflow-wrap: anywhere }
+</style></head><body><pre>
+{{.Text}}</pre></body></html>
+`))
+
+// serveText handles requests with text/plain bodies: text is converted in
+// monospaced font, with lines wrapped to fit the page unless X-Pdf-Wrap
+// header is false. Font size is set with X-Pdf-Font-Size header.
+func (h *handler) serveText(w http.ResponseWriter, r *http.Request) {
+	opts, err := h.requestOptions(r)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	body, err := charset.NewReader(r.Body, r.Header.Get("Content-Type"))
+	if err != nil {
+		h.error(w, http.StatusUnsupportedMediaType)
+		return
+	}
+	text, err := io.ReadAll(body)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	data := struct{ FontSize, WhiteSpace, Text string }{"10pt", "pre-wrap", string(text)}
+	if opts.text.fontSize != "" {
+		data.FontSize = opts.text.fontSize
+	}
+	if opts.text.noWrap {
+		data.WhiteSpace = "pre"
+	}
+	buf := new(bytes.Buffer)
+	if err := textPage.Execute(buf, data); err != nil {
+		ctxLogger(r.Context()).Error("executing text page failed", "error", err)
+		h.error(w, http.StatusInternalServerError)
+		return
+	}
+	h.serveConverted(w, r, source{r: buf})
+}
+
+// textOptions are options of plain text conversion
+type textOptions struct {
+	fontSize string // CSS length
+	noWrap   bool   // don't wrap long lines
+}
+
+// parseTextOptions validates plain text options from X-Pdf-Font-Size and
+// X-Pdf-Wrap headers
+func parseTextOptions(hdr http.Header) (textOptions, error) {
+	var t textOptions
+	if s := hdr.Get("X-Pdf-Font-Size"); s != "" {
+		if !cssLength.MatchString(s) || s == "0" {
+			return t, fmt.Errorf("invalid font size %q", s)
+		}
+		t.fontSize = s
+	}
+	if s := hdr.Get("X-Pdf-Wrap"); s != "" {
+		wrap, err := strconv.ParseBool(s)
+		if err != nil {
+			return t, err
+		}
+		t.noWrap = !wrap
+	}
+	return t, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// certReloader keeps TLS certificate loaded from files, reloading it when
+// files are modified
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads certificate from files. On error, previously loaded
+// certificate is kept.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	return nil
+}
+
+// watch periodically checks whether certificate files were modified and
+// reloads them if so. It never returns.
+func (cr *certReloader) watch(interval time.Duration) {
+	watchFiles(interval, func() {
+		if err := cr.reload(); err != nil {
+			slog.Error("certificate reload failed", "error", err)
+			return
+		}
+		slog.Info("certificate reloaded")
+	}, cr.certFile, cr.keyFile)
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
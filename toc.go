@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// tocClass is a class of the table of contents element inserted by
+// insertTOC, documents may use it to style the table
+const tocClass = "pdfsvc-toc"
+
+// tocStyle is applied to the table of contents. Page numbers are only
+// filled in by renderers supporting CSS target-counter, i.e. weasyprint.
+const tocStyle = `nav.pdfsvc-toc { break-after: page }
+nav.pdfsvc-toc ul { list-style: none; padding: 0 }
+nav.pdfsvc-toc li.level-2 { padding-left: 1.5em }
+nav.pdfsvc-toc li.level-3 { padding-left: 3em }
+nav.pdfsvc-toc a { color: inherit; text-decoration: none }
+nav.pdfsvc-toc a::after { content: leader('.') target-counter(attr(href), page) }`
+
+// tocLevels maps heading elements listed in the table of contents to their
+// nesting levels
+var tocLevels = map[atom.Atom]int{atom.H1: 1, atom.H2: 2, atom.H3: 3}
+
+// insertTOC inserts table of contents listing h1-h3 headings at the
+// beginning of document body. Headings with no id attribute are given one,
+// so that table entries can link to them.
+func insertTOC(doc *html.Node) error {
+	head, body := findElement(doc, atom.Head), findElement(doc, atom.Body)
+	if head == nil || body == nil {
+		return errors.New("document has no head or body")
+	}
+	ids := make(map[string]bool)
+	var headings []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if id := attr(n, "id"); id != "" {
+				ids[id] = true
+			}
+			if tocLevels[n.DataAtom] != 0 {
+				headings = append(headings, n)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(body)
+	if len(headings) == 0 {
+		return nil
+	}
+	list := &html.Node{Type: html.ElementNode, Data: "ul", DataAtom: atom.Ul}
+	for i, hd := range headings {
+		id := attr(hd, "id")
+		if id == "" {
+			for n := i + 1; id == "" || ids[id]; n++ {
+				id = "pdfsvc-toc-" + strconv.Itoa(n)
+			}
+			ids[id] = true
+			setAttr(hd, "id", id)
+		}
+		a := &html.Node{Type: html.ElementNode, Data: "a", DataAtom: atom.A,
+			Attr: []html.Attribute{{Key: "href", Val: "#" + id}}}
+		a.AppendChild(&html.Node{Type: html.TextNode, Data: strings.Join(strings.Fields(textContent(hd)), " ")})
+		li := &html.Node{Type: html.ElementNode, Data: "li", DataAtom: atom.Li,
+			Attr: []html.Attribute{{Key: "class", Val: "level-" + strconv.Itoa(tocLevels[hd.DataAtom])}}}
+		li.AppendChild(a)
+		list.AppendChild(li)
+	}
+	nav := &html.Node{Type: html.ElementNode, Data: "nav", DataAtom: atom.Nav,
+		Attr: []html.Attribute{{Key: "class", Val: tocClass}}}
+	nav.AppendChild(list)
+	body.InsertBefore(nav, body.FirstChild)
+	// prepend, so that document styles can override defaults
+	style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style}
+	style.AppendChild(&html.Node{Type: html.TextNode, Data: tocStyle})
+	head.InsertBefore(style, head.FirstChild)
+	return nil
+}
+
+// applyTOC returns src with table of contents inserted into its html
+// document
+func applyTOC(src source) (source, error) {
+	switch {
+	case src.url != "":
+		// there's no way to modify a remote document
+		return src, errUnsupported
+	case src.file != "":
+		return src, rewriteDocFile(src.file, insertTOC)
+	}
+	r, err := rewriteDoc(src.r, insertTOC)
+	if err != nil {
+		return src, err
+	}
+	src.r = r
+	return src, nil
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns concatenated text of all text nodes under n
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+	return sb.String()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// serveURL handles requests to /url: request body is a JSON object holding url
+// of a remote document to convert, {"url": "https://example.com/"}. Only urls
+// with hosts from handler's allowlist are accepted.
+func (h *handler) serveURL(w http.ResponseWriter, r *http.Request) {
+	if !h.accept(w, r) {
+		return
+	}
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	u, err := parseHTTPURL(req.URL)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if !h.urlHosts[strings.ToLower(u.Hostname())] {
+		h.error(w, http.StatusForbidden)
+		return
+	}
+	h.serveConverted(w, r, source{url: u.String()})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// finding is a single problem reported by /validate
+type finding struct {
+	Severity string `json:"severity"` // "error" if conversion would fail, "warning" otherwise
+	Check    string `json:"check"`
+	Message  string `json:"message"`
+}
+
+// validation is a reply of /validate
+type validation struct {
+	Valid    bool      `json:"valid"` // false if there are findings of "error" severity
+	Size     int       `json:"size"`
+	Charset  string    `json:"charset,omitempty"`
+	Findings []finding `json:"findings"`
+}
+
+func (v *validation) add(severity, check, msg string) {
+	v.Findings = append(v.Findings, finding{Severity: severity, Check: check, Message: msg})
+	if severity == "error" {
+		v.Valid = false
+	}
+}
+
+// serveValidate handles POST /validate requests with html document bodies.
+// It runs the same checks as conversion does before starting renderer, along
+// with some lint-like checks of the document, and replies with findings as
+// JSON. Reply status is 200 OK whether document is valid or not.
+func (h *handler) serveValidate(w http.ResponseWriter, r *http.Request) {
+	if !h.accept(w, r) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	v := &validation{Valid: true, Size: len(body), Findings: []finding{}}
+	h.validateOptions(v, r)
+	ct := r.Header.Get("Content-Type")
+	if mt, _, _ := mime.ParseMediaType(ct); mt != "text/html" {
+		v.add("error", "content-type", "Content-Type must be text/html")
+	} else {
+		validateDocument(v, body, ct)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// validateOptions checks X-Pdf-* request headers
+func (h *handler) validateOptions(v *validation, r *http.Request) {
+	opts, err := h.requestOptions(r)
+	if err != nil {
+		v.add("error", "options", err.Error())
+		return
+	}
+	if opts.sink != nil && !h.sinkAllowed(opts.sink) {
+		v.add("error", "options", "X-Pdf-Sink url is not allowed")
+	}
+	if _, ok := h.renderer.(weasyPrint); ok && opts.jsDelay > 0 {
+		v.add("error", "options", "X-Pdf-Javascript-Delay is not supported by the renderer")
+	}
+}
+
+// validateDocument checks html document in body, sent with contentType
+func validateDocument(v *validation, body []byte, contentType string) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		v.add("error", "size", "document is empty")
+		return
+	}
+	enc, name, certain := charset.DetermineEncoding(body, contentType)
+	v.Charset = name
+	if _, params, _ := mime.ParseMediaType(contentType); params["charset"] != "" {
+		if e, _ := charset.Lookup(params["charset"]); e == nil {
+			v.add("error", "charset", "unsupported charset "+params["charset"])
+			return
+		}
+	} else if !certain {
+		v.add("warning", "charset", "charset is neither set in Content-Type nor declared in document, guessed "+name)
+	}
+	utf8Body, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		v.add("error", "charset", "document cannot be decoded as "+name)
+		return
+	}
+	if name == "utf-8" && !utf8.Valid(body) {
+		v.add("warning", "charset", "document has invalid utf-8 sequences")
+	}
+	doc, err := html.Parse(bytes.NewReader(utf8Body))
+	if err != nil {
+		v.add("error", "html", err.Error())
+		return
+	}
+	var doctype, title bool
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.DoctypeNode:
+			doctype = true
+		case n.Type == html.ElementNode && n.DataAtom == atom.Title:
+			title = n.FirstChild != nil && strings.TrimSpace(n.FirstChild.Data) != ""
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	if !doctype {
+		v.add("warning", "html", "document has no doctype, it's rendered in quirks mode")
+	}
+	if !title {
+		v.add("warning", "html", "document has no title, PDF documents use it as their title unless X-Pdf-Title is set")
+	}
+}
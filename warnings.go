@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// warnLevel selects renderer messages reported in X-Pdf-Warnings header
+type warnLevel int
+
+const (
+	warnNone    warnLevel = iota // report nothing
+	warnError                    // report errors, i.e. missing images
+	warnWarning                  // report errors and warnings
+)
+
+func parseWarnLevel(s string) (warnLevel, error) {
+	switch strings.ToLower(s) {
+	case "", "error":
+		return warnError, nil
+	case "warning":
+		return warnWarning, nil
+	case "none":
+		return warnNone, nil
+	}
+	return warnError, errors.New("unsupported warning level")
+}
+
+const (
+	maxWarnings   = 20  // max number of reported renderer messages
+	maxWarningLen = 256 // max length of a reported renderer message
+)
+
+// rendererMessage matches error and warning messages renderers write to
+// stderr: "ERROR: text" by WeasyPrint, "[pid:tid:date:ERROR:file.cc(1)] text"
+// by Chromium
+var rendererMessage = regexp.MustCompile(`^(?:(ERROR|WARNING): |\[[^\]]*:(ERROR|WARNING):[^\]]*\] )(.+)$`)
+
+// parseWarnings returns renderer messages of the given level and above
+// found in its stderr output, as "LEVEL: text" strings
+func parseWarnings(stderr []byte, level warnLevel) []string {
+	if level == warnNone {
+		return nil
+	}
+	var out []string
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(stderr))
+	for sc.Scan() && len(out) < maxWarnings {
+		m := rendererMessage.FindStringSubmatch(strings.TrimSpace(sc.Text()))
+		if m == nil {
+			continue
+		}
+		lvl := m[1] + m[2]
+		if lvl == "WARNING" && level < warnWarning {
+			continue
+		}
+		msg := lvl + ": " + headerSafe(m[3])
+		if seen[msg] {
+			continue
+		}
+		seen[msg] = true
+		out = append(out, msg)
+	}
+	return out
+}
+
+// headerSafe returns s with control characters removed, truncated to
+// maxWarningLen bytes so that it's usable as a header value
+func headerSafe(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > maxWarningLen {
+		s = strings.ToValidUTF8(s[:maxWarningLen], "")
+	}
+	return s
+}
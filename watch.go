@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// watchFiles checks modification times of named files every interval and
+// calls fn each time any of them changes. It never returns.
+func watchFiles(interval time.Duration, fn func(), names ...string) {
+	last, _ := filesModTime(names...)
+	for range time.Tick(interval) {
+		mtime, err := filesModTime(names...)
+		if err != nil {
+			slog.Error("file check failed", "error", err)
+			continue
+		}
+		if mtime.Equal(last) {
+			continue
+		}
+		last = mtime
+		fn()
+	}
+}
+
+// filesModTime returns the latest modification time of named files
+func filesModTime(names ...string) (time.Time, error) {
+	var mtime time.Time
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t := fi.ModTime(); t.After(mtime) {
+			mtime = t
+		}
+	}
+	return mtime, nil
+}